@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keyEncoders maps the values of the encoding flag to functions returning the
+// DNS label of a public key. They mirror the encodings accepted by wgsd.
+var keyEncoders = map[string]func(key wgtypes.Key) string{
+	"base32": func(key wgtypes.Key) string {
+		return base32.StdEncoding.EncodeToString(key[:])
+	},
+	"base32-nopad": func(key wgtypes.Key) string {
+		return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key[:])
+	},
+	"base32hex": func(key wgtypes.Key) string {
+		return base32.HexEncoding.EncodeToString(key[:])
+	},
+	"base32hex-nopad": func(key wgtypes.Key) string {
+		return base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(key[:])
+	},
+	"base64url": func(key wgtypes.Key) string {
+		return base64.RawURLEncoding.EncodeToString(key[:])
+	},
+}
+
+// keyEncoder returns the encoder for the named encoding, ignoring case.
+func keyEncoder(name string) (func(key wgtypes.Key) string, bool) {
+	encode, ok := keyEncoders[strings.ToLower(name)]
+	return encode, ok
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestKeyEncoder(t *testing.T) {
+	key, err := wgtypes.ParseKey("xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=")
+	if err != nil {
+		t.Fatalf("error parsing key: %v", err)
+	}
+	testCases := []struct {
+		encoding string
+		want     string
+	}{
+		{"base32", "YUTRLED535IGKL7BDLERL6M4VJXSXM3UQQPL4NMSN27MT56AD4HA===="},
+		{"BASE32-NOPAD", "YUTRLED535IGKL7BDLERL6M4VJXSXM3UQQPL4NMSN27MT56AD4HA"},
+		{"base32hex", "OKJHB43TRT86ABV13B4HBUCSL9NINCRKGGFBSDCIDQVCJTU03S70===="},
+		{"base32hex-nopad", "OKJHB43TRT86ABV13B4HBUCSL9NINCRKGGFBSDCIDQVCJTU03S70"},
+		{"base64url", "xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6-yffAHw4"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.encoding, func(t *testing.T) {
+			encode, ok := keyEncoder(tc.encoding)
+			if !ok {
+				t.Fatalf("missing encoder for %s", tc.encoding)
+			}
+			if got := encode(key); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+	if _, ok := keyEncoder("hex"); ok {
+		t.Error("unexpected encoder for hex")
+	}
+}
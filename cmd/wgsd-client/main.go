@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/base32"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -23,7 +22,14 @@ var (
 		"name of Wireguard device to manage")
 	dnsServerFlag = flag.String("dns", "",
 		"ip:port of DNS server")
-	dnsZoneFlag = flag.String("zone", "", "dns zone name")
+	dnsZoneFlag    = flag.String("zone", "", "dns zone name")
+	tsigKeyFlag    = flag.String("tsig-key", "", "name of TSIG key to sign queries with")
+	tsigSecretFlag = flag.String("tsig-secret", "",
+		"base64-encoded TSIG secret, required with -tsig-key")
+	tsigAlgorithmFlag = flag.String("tsig-algorithm", dns.HmacSHA256,
+		"TSIG algorithm")
+	encodingFlag = flag.String("encoding", "base32",
+		"encoding of public keys in query names: base32, base32-nopad, base32hex, base32hex-nopad or base64url")
 )
 
 func main() {
@@ -41,6 +47,13 @@ func main() {
 	if err != nil {
 		log.Fatalf("invalid dns flag value: %v", err)
 	}
+	if len(*tsigKeyFlag) > 0 && len(*tsigSecretFlag) < 1 {
+		log.Fatal("missing tsig-secret flag")
+	}
+	encodeKey, ok := keyEncoder(*encodingFlag)
+	if !ok {
+		log.Fatalf("invalid encoding flag value: %s", *encodingFlag)
+	}
 	wgClient, err := wgctrl.New()
 	if err != nil {
 		log.Fatalf("error constructing Wireguard control client: %v",
@@ -64,6 +77,13 @@ func main() {
 		dnsClient := &dns.Client{
 			Timeout: time.Second * 5,
 		}
+		tsigKey := dns.Fqdn(*tsigKeyFlag)
+		if len(*tsigKeyFlag) > 0 {
+			dnsClient.TsigSecret = map[string]string{tsigKey: *tsigSecretFlag}
+		}
+		// truncated responses are retried over TCP
+		tcpClient := *dnsClient
+		tcpClient.Net = "tcp"
 		for _, peer := range wgDevice.Peers {
 			select {
 			case <-ctx.Done():
@@ -71,13 +91,21 @@ func main() {
 			default:
 			}
 			srvCtx, srvCancel := context.WithCancel(ctx)
-			pubKeyBase32 := base32.StdEncoding.EncodeToString(peer.PublicKey[:])
+			pubKeyLabel := encodeKey(peer.PublicKey)
 			pubKeyBase64 := base64.StdEncoding.EncodeToString(peer.PublicKey[:])
 			m := &dns.Msg{}
 			question := fmt.Sprintf("%s._wireguard._udp.%s",
-				pubKeyBase32, dns.Fqdn(*dnsZoneFlag))
+				pubKeyLabel, dns.Fqdn(*dnsZoneFlag))
 			m.SetQuestion(question, dns.TypeSRV)
+			if len(*tsigKeyFlag) > 0 {
+				m.SetEdns0(dns.DefaultMsgSize, false)
+				m.SetTsig(tsigKey, dns.Fqdn(*tsigAlgorithmFlag), 300,
+					time.Now().Unix())
+			}
 			r, _, err := dnsClient.ExchangeContext(srvCtx, m, *dnsServerFlag)
+			if err == nil && r.Truncated {
+				r, _, err = tcpClient.ExchangeContext(srvCtx, m, *dnsServerFlag)
+			}
 			srvCancel()
 			if err != nil {
 				log.Printf(
@@ -97,6 +125,7 @@ func main() {
 			if len(r.Extra) < 1 {
 				log.Printf("[%s] SRV response missing extra A/AAAA",
 					pubKeyBase64)
+				continue
 			}
 			var endpointIP net.IP
 			hostA, ok := r.Extra[0].(*dns.A)
@@ -112,6 +141,28 @@ func main() {
 			} else {
 				endpointIP = hostA.A
 			}
+			var txt *dns.TXT
+			for _, rr := range r.Extra {
+				if t, ok := rr.(*dns.TXT); ok {
+					txt = t
+					break
+				}
+			}
+			if txt == nil {
+				log.Printf("[%s] SRV response missing extra TXT",
+					pubKeyBase64)
+				continue
+			}
+			peerTXT, err := parseTXT(txt.Txt)
+			if err != nil {
+				log.Printf("[%s] failed to parse TXT: %v", pubKeyBase64, err)
+				continue
+			}
+			if peerTXT.publicKey != peer.PublicKey {
+				log.Printf("[%s] TXT for mismatched public key: %s",
+					pubKeyBase64, peerTXT.publicKey)
+				continue
+			}
 			peerConfig := wgtypes.PeerConfig{
 				PublicKey:  peer.PublicKey,
 				UpdateOnly: true,
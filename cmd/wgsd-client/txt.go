@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerTXT is the content of the TXT RR served by wgsd for a peer.
+type peerTXT struct {
+	version    int
+	publicKey  wgtypes.Key
+	allowedIPs []net.IPNet
+}
+
+// parseTXT parses the character-strings of a peer's TXT RR. Versions 1 and 2
+// are supported. Version 1 carries all allowed IPs in the allowed key, version
+// 2 continues them in the allowed1, allowed2, ... keys.
+func parseTXT(txt []string) (*peerTXT, error) {
+	kvs := make(map[string]string, len(txt))
+	for i, s := range txt {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid key/value pair: %s", s)
+		}
+		key = strings.ToLower(key)
+		if i == 0 && key != "txtvers" {
+			return nil, fmt.Errorf("missing txtvers key")
+		}
+		if _, ok := kvs[key]; ok {
+			// RFC6763 section 6.4, only the first occurrence is used
+			continue
+		}
+		kvs[key] = value
+	}
+	if len(kvs) == 0 {
+		return nil, fmt.Errorf("missing txtvers key")
+	}
+
+	p := &peerTXT{}
+	var err error
+	p.version, err = strconv.Atoi(kvs["txtvers"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid txtvers: %s", kvs["txtvers"])
+	}
+	if p.version < 1 || p.version > 2 {
+		return nil, fmt.Errorf("unsupported txtvers: %d", p.version)
+	}
+
+	pub, ok := kvs["pub"]
+	if !ok {
+		return nil, fmt.Errorf("missing pub key")
+	}
+	p.publicKey, err = wgtypes.ParseKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pub: %v", err)
+	}
+
+	allowed, ok := kvs["allowed"]
+	if !ok {
+		return nil, fmt.Errorf("missing allowed key")
+	}
+	values := []string{allowed}
+	if p.version >= 2 {
+		for i := 1; ; i++ {
+			value, ok := kvs[fmt.Sprintf("allowed%d", i)]
+			if !ok {
+				break
+			}
+			values = append(values, value)
+		}
+	}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		for _, s := range strings.Split(value, ",") {
+			_, prefix, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed IP: %v", err)
+			}
+			p.allowedIPs = append(p.allowedIPs, *prefix)
+		}
+	}
+	return p, nil
+}
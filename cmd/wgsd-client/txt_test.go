@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseTXT(t *testing.T) {
+	const pub = "xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4="
+
+	testCases := []struct {
+		name        string
+		txt         []string
+		wantErr     bool
+		wantVersion int
+		wantAllowed string
+	}{
+		{
+			name:        "version 1",
+			txt:         []string{"txtvers=1", "pub=" + pub, "allowed=10.0.0.1/32,fd00::1/128"},
+			wantVersion: 1,
+			wantAllowed: "[10.0.0.1/32 fd00::1/128]",
+		},
+		{
+			name:        "version 1 ignores indexed keys",
+			txt:         []string{"txtvers=1", "pub=" + pub, "allowed=10.0.0.1/32", "allowed1=10.0.0.2/32"},
+			wantVersion: 1,
+			wantAllowed: "[10.0.0.1/32]",
+		},
+		{
+			name:        "version 2",
+			txt:         []string{"txtvers=2", "pub=" + pub, "allowed=10.0.0.1/32", "allowed1=10.0.0.2/32,10.0.0.3/32", "allowed2=fd00::1/128", "tags=gateway"},
+			wantVersion: 2,
+			wantAllowed: "[10.0.0.1/32 10.0.0.2/32 10.0.0.3/32 fd00::1/128]",
+		},
+		{
+			name:        "version 2 no allowed IPs",
+			txt:         []string{"txtvers=2", "pub=" + pub, "allowed="},
+			wantVersion: 2,
+			wantAllowed: "[]",
+		},
+		{
+			name:    "missing txtvers",
+			txt:     []string{"pub=" + pub, "allowed=10.0.0.1/32"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported version",
+			txt:     []string{"txtvers=3", "pub=" + pub, "allowed=10.0.0.1/32"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid pub",
+			txt:     []string{"txtvers=2", "pub=invalid", "allowed=10.0.0.1/32"},
+			wantErr: true,
+		},
+		{
+			name:    "missing allowed",
+			txt:     []string{"txtvers=2", "pub=" + pub},
+			wantErr: true,
+		},
+		{
+			name:    "invalid allowed IP",
+			txt:     []string{"txtvers=2", "pub=" + pub, "allowed=10.0.0.1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := parseTXT(tc.txt)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if p.version != tc.wantVersion {
+				t.Errorf("expected version %d, got %d", tc.wantVersion, p.version)
+			}
+			if p.publicKey.String() != pub {
+				t.Errorf("expected pub %s, got %s", pub, p.publicKey)
+			}
+			var allowed []string
+			for _, prefix := range p.allowedIPs {
+				allowed = append(allowed, prefix.String())
+			}
+			if got := fmt.Sprint(allowed); got != tc.wantAllowed {
+				t.Errorf("expected allowed IPs %s, got %s", tc.wantAllowed, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package wgsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// confClient is a PeerSource serving devices from wg-quick configuration
+// files, for publishing peers of devices that are not configured locally. The
+// device of a file is named after it, e.g. wg0 for /etc/wireguard/wg0.conf.
+// Files are reloaded when they change.
+type confClient struct {
+	paths map[string]string // configuration file paths by device name
+
+	mu    sync.Mutex
+	files map[string]*confFile // loaded files by device name
+}
+
+// confFile is a loaded configuration file.
+type confFile struct {
+	modTime time.Time
+	size    int64
+	device  *wgtypes.Device
+}
+
+// newConfClient returns a confClient for the configuration files at paths.
+// The files are loaded so that invalid files are rejected early.
+func newConfClient(paths []string) (*confClient, error) {
+	c := &confClient{
+		paths: make(map[string]string),
+		files: make(map[string]*confFile),
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".conf")
+		if _, ok := c.paths[name]; ok {
+			return nil, fmt.Errorf("duplicate configuration for device %s: %s", name, path)
+		}
+		c.paths[name] = path
+		if _, err := c.Device(context.Background(), name); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Device returns the device configured in the file named after it, reloading
+// the file if it changed. If a changed file can't be loaded the previously
+// loaded device is returned.
+func (c *confClient) Device(_ context.Context, name string) (*wgtypes.Device, error) {
+	path, ok := c.paths[name]
+	if !ok {
+		return nil, fmt.Errorf("no configuration file for device %s", name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	loaded := c.files[name]
+	info, err := os.Stat(path)
+	if err == nil && loaded != nil && info.ModTime().Equal(loaded.modTime) &&
+		info.Size() == loaded.size {
+		return loaded.device, nil
+	}
+	if err == nil {
+		var device *wgtypes.Device
+		device, err = readConf(path)
+		if err == nil {
+			device.Name = name
+			c.files[name] = &confFile{
+				modTime: info.ModTime(),
+				size:    info.Size(),
+				device:  device,
+			}
+			return device, nil
+		}
+	}
+	if loaded == nil {
+		return nil, err
+	}
+	logger.Errorf("error reloading %s, serving previous configuration: %v", path, err)
+	return loaded.device, nil
+}
+
+// Devices returns the devices of all configuration files.
+func (c *confClient) Devices(ctx context.Context) ([]*wgtypes.Device, error) {
+	devices := make([]*wgtypes.Device, 0, len(c.paths))
+	for name := range c.paths {
+		device, err := c.Device(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// readConf reads a wg-quick configuration file. Of the [Interface] section
+// the PrivateKey and ListenPort keys are used, of [Peer] sections the
+// PublicKey, PresharedKey, Endpoint, AllowedIPs, and PersistentKeepalive keys.
+// Other keys, such as those only interpreted by wg-quick, are ignored.
+// Endpoints must be in ip:port form, as files are read while queries wait, and
+// resolving host names could recurse into this server.
+func readConf(path string) (*wgtypes.Device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	device := &wgtypes.Device{}
+	var peer *wgtypes.Peer
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				if peer != nil {
+					device.Peers = append(device.Peers, *peer)
+				}
+				peer = &wgtypes.Peer{}
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown section %s", path, lineNum, line)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch section {
+		case "interface":
+			err = parseConfInterface(device, key, value)
+		case "peer":
+			err = parseConfPeer(peer, key, value)
+		default:
+			err = fmt.Errorf("key outside of a section")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid %s: %v", path, lineNum, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if peer != nil {
+		device.Peers = append(device.Peers, *peer)
+	}
+	for _, peer := range device.Peers {
+		if peer.PublicKey == (wgtypes.Key{}) {
+			return nil, fmt.Errorf("%s: peer without PublicKey", path)
+		}
+	}
+	return device, nil
+}
+
+func parseConfInterface(device *wgtypes.Device, key, value string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		device.PrivateKey, err = wgtypes.ParseKey(value)
+		device.PublicKey = device.PrivateKey.PublicKey()
+	case "listenport":
+		device.ListenPort, err = strconv.Atoi(value)
+	}
+	return err
+}
+
+func parseConfPeer(peer *wgtypes.Peer, key, value string) error {
+	var err error
+	switch key {
+	case "publickey":
+		peer.PublicKey, err = wgtypes.ParseKey(value)
+	case "presharedkey":
+		peer.PresharedKey, err = wgtypes.ParseKey(value)
+	case "endpoint":
+		var endpoint netip.AddrPort
+		endpoint, err = netip.ParseAddrPort(value)
+		if err != nil {
+			return fmt.Errorf("%s is not in ip:port form, host names are not resolved", value)
+		}
+		peer.Endpoint = net.UDPAddrFromAddrPort(endpoint)
+	case "allowedips":
+		for _, s := range strings.Split(value, ",") {
+			var prefix *net.IPNet
+			_, prefix, err = net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+		}
+	case "persistentkeepalive":
+		if value == "off" {
+			break
+		}
+		var seconds int
+		seconds, err = strconv.Atoi(value)
+		peer.PersistentKeepaliveInterval = time.Duration(seconds) * time.Second
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestReadConf(t *testing.T) {
+	privateKey, _ := wgtypes.ParseKey("kJo0CsTvdXuUFMW5J6GZ4GBFBhWTKL0xl0P1KfMdSUs=")
+	pub1 := "xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4="
+	pub2 := "syKB97XhGnvC+kynh2KqQJPXoOoOpx/HmpMRTc+r4js="
+	key1, _ := wgtypes.ParseKey(pub1)
+	key2, _ := wgtypes.ParseKey(pub2)
+	_, prefix1, _ := net.ParseCIDR("10.0.0.1/32")
+	_, prefix2, _ := net.ParseCIDR("fd00::/64")
+	_, prefix3, _ := net.ParseCIDR("10.0.0.2/32")
+
+	testCases := []struct {
+		name      string
+		content   string
+		shouldErr bool
+		want      *wgtypes.Device
+	}{
+		{
+			"valid",
+			fmt.Sprintf(`# staging hub
+[Interface]
+PrivateKey = %s
+ListenPort = 51820
+Address = 10.0.0.254/24
+PostUp = echo up
+
+[Peer] # alice
+PublicKey = %s
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.0.0.1/32, fd00::/64
+PersistentKeepalive = 25
+
+[peer]
+publickey = %s
+AllowedIPs = 10.0.0.2/32
+PersistentKeepalive = off
+`, privateKey, pub1, pub2),
+			false,
+			&wgtypes.Device{
+				PrivateKey: privateKey,
+				PublicKey:  privateKey.PublicKey(),
+				ListenPort: 51820,
+				Peers: []wgtypes.Peer{
+					{
+						PublicKey: key1,
+						Endpoint: &net.UDPAddr{
+							IP:   net.ParseIP("192.0.2.1").To4(),
+							Port: 51820,
+						},
+						AllowedIPs:                  []net.IPNet{*prefix1, *prefix2},
+						PersistentKeepaliveInterval: 25 * time.Second,
+					},
+					{
+						PublicKey:  key2,
+						AllowedIPs: []net.IPNet{*prefix3},
+					},
+				},
+			},
+		},
+		{
+			"unknown section",
+			"[Interfaces]\n",
+			true,
+			nil,
+		},
+		{
+			"key outside of a section",
+			"ListenPort = 51820\n",
+			true,
+			nil,
+		},
+		{
+			"invalid allowed ips",
+			fmt.Sprintf("[Peer]\nPublicKey = %s\nAllowedIPs = 10.0.0.1\n", pub1),
+			true,
+			nil,
+		},
+		{
+			"endpoint host name",
+			fmt.Sprintf("[Peer]\nPublicKey = %s\nEndpoint = localhost:51820\n", pub1),
+			true,
+			nil,
+		},
+		{
+			"peer without public key",
+			"[Peer]\nAllowedIPs = 10.0.0.1/32\n",
+			true,
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wg0.conf")
+			if err := os.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatalf("error writing conf: %v", err)
+			}
+			device, err := readConf(path)
+			if (err != nil) != tc.shouldErr {
+				t.Fatalf("expected error: %v, got: %v", tc.shouldErr, err)
+			}
+			if err == nil && !reflect.DeepEqual(device, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, device)
+			}
+		})
+	}
+}
+
+func TestConfClient(t *testing.T) {
+	key1 := [32]byte{}
+	key1[0] = 1
+	key2 := [32]byte{}
+	key2[0] = 2
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg-staging.conf")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("error writing conf: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("error setting conf times: %v", err)
+		}
+	}
+	modTime := time.Now().Add(-time.Hour)
+	write(fmt.Sprintf("[Peer]\nPublicKey = %s\nEndpoint = 192.0.2.1:1\n",
+		wgtypes.Key(key1)), modTime)
+
+	c := caddy.NewTestController("dns", fmt.Sprintf(`wgsd example.com. wg-staging {
+		conf %s
+	}`, path))
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no errors, but got '%v'", err)
+	}
+	p := &WGSD{
+		Next:   test.ErrorHandler(),
+		Zones:  zones,
+		client: &mockClient{},
+	}
+	ptrs := func() []dns.RR {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion("_wireguard._udp.example.com.", dns.TypePTR)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := p.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return rec.Msg.Answer
+	}
+	zone := zones.Z["example.com."]
+	want1 := test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s",
+		instanceName(zone, wgtypes.Peer{PublicKey: key1})))
+	want2 := test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s",
+		instanceName(zone, wgtypes.Peer{PublicKey: key2})))
+	if answer := ptrs(); len(answer) != 1 || answer[0].String() != want1.String() {
+		t.Fatalf("expected %v, got %v", want1, answer)
+	}
+
+	// unchanged files are not reloaded
+	client := zone.client.(*confClient)
+	first, _ := client.Device(context.Background(), "wg-staging")
+	second, _ := client.Device(context.Background(), "wg-staging")
+	if first != second {
+		t.Error("expected unchanged file to be loaded once")
+	}
+
+	// changed files are reloaded
+	modTime = modTime.Add(time.Minute)
+	write(fmt.Sprintf("[Peer]\nPublicKey = %s\nEndpoint = 192.0.2.2:2\n",
+		wgtypes.Key(key2)), modTime)
+	if answer := ptrs(); len(answer) != 1 || answer[0].String() != want2.String() {
+		t.Fatalf("expected %v, got %v", want2, answer)
+	}
+
+	// invalid changes keep the previous configuration
+	modTime = modTime.Add(time.Minute)
+	write("[Peer]\nPublicKey = invalid\n", modTime)
+	if answer := ptrs(); len(answer) != 1 || answer[0].String() != want2.String() {
+		t.Fatalf("expected %v, got %v", want2, answer)
+	}
+
+	// devices must have a configuration file
+	write(fmt.Sprintf("[Peer]\nPublicKey = %s\n", wgtypes.Key(key1)), modTime)
+	c = caddy.NewTestController("dns", fmt.Sprintf(`wgsd example.com. wg0 {
+		conf %s
+	}`, path))
+	if _, err := parse(c); err == nil {
+		t.Error("expected error for device without configuration file")
+	}
+}
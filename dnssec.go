@@ -0,0 +1,153 @@
+package wgsd
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// typeNXNAME is the NSEC type bitmap pseudo-type signaling a nonexistent name
+// in compact denial of existence responses, see RFC9824.
+const typeNXNAME uint16 = 128
+
+const (
+	// signature validity relative to the time of signing
+	sigInceptionOffset  = -3 * time.Hour
+	sigExpirationOffset = 7 * 24 * time.Hour
+)
+
+// dnssecKey is a DNSSEC key used to sign the RRs of a zone.
+type dnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+	tag    uint16
+}
+
+// readDNSSECKey reads a DNSSEC key pair as written by dnssec-keygen or
+// ldns-keygen. base is the path of the key files without the .key or .private
+// extension.
+func readDNSSECKey(base string) (*dnssecKey, error) {
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".key"), ".private")
+	pubFile, privFile := base+".key", base+".private"
+
+	f, err := os.Open(pubFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, pubFile)
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a DNSKEY RR", pubFile)
+	}
+
+	f, err = os.Open(privFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	priv, err := dnskey.ReadPrivateKey(f, privFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a supported private key", privFile)
+	}
+
+	return &dnssecKey{
+		dnskey: dnskey,
+		signer: signer,
+		tag:    dnskey.KeyTag(),
+	}, nil
+}
+
+// signing returns true if the response to state should be signed.
+func signing(state request.Request, zone *Zone) bool {
+	return len(zone.keys) > 0 && state.Do()
+}
+
+// dnskeyRRs returns the DNSKEY RRset of zone.
+func dnskeyRRs(zone *Zone) []dns.RR {
+	rrs := make([]dns.RR, 0, len(zone.keys))
+	for _, key := range zone.keys {
+		rrs = append(rrs, key.dnskey)
+	}
+	return rrs
+}
+
+// signRRs returns rrs followed by an RRSIG per key for every RRset in rrs.
+func signRRs(zone *Zone, rrs []dns.RR) []dns.RR {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var order []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := rrsetKey{
+			name:   strings.ToLower(rr.Header().Name),
+			rrtype: rr.Header().Rrtype,
+		}
+		if _, ok := rrsets[k]; !ok {
+			order = append(order, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+
+	now := time.Now()
+	signed := rrs
+	for _, k := range order {
+		rrset := rrsets[k]
+		for _, key := range zone.keys {
+			sig := &dns.RRSIG{
+				Hdr: dns.RR_Header{
+					Ttl: rrset[0].Header().Ttl,
+				},
+				Algorithm:  key.dnskey.Algorithm,
+				KeyTag:     key.tag,
+				SignerName: zone.name,
+				Inception:  uint32(now.Add(sigInceptionOffset).Unix()),
+				Expiration: uint32(now.Add(sigExpirationOffset).Unix()),
+			}
+			err := sig.Sign(key.signer, rrset)
+			if err != nil {
+				logger.Errorf("error signing %s %s RRset: %v", k.name,
+					dns.TypeToString[k.rrtype], err)
+				continue
+			}
+			signed = append(signed, sig)
+		}
+	}
+	return signed
+}
+
+// compactNSEC returns an NSEC RR for name with the given types for compact
+// denial of existence, see RFC9824. The next domain name is the immediate
+// lexicographic successor of name, so the NSEC RR covers no other names.
+func compactNSEC(zone *Zone, name string, types ...uint16) *dns.NSEC {
+	bitmap := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    zone.ttl.negative,
+		},
+		NextDomain: "\\000." + name,
+		TypeBitMap: bitmap,
+	}
+}
@@ -0,0 +1,223 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// writeDNSSECKey generates a DNSSEC key for zone and writes it to dir in the
+// format of dnssec-keygen, returning the base path of the key files.
+func writeDNSSECKey(t *testing.T, dir, zone string) string {
+	t.Helper()
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := dnskey.Generate(256)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone,
+		dnskey.Algorithm, dnskey.KeyTag()))
+	err = os.WriteFile(base+".key", []byte(dnskey.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("error writing public key: %v", err)
+	}
+	err = os.WriteFile(base+".private", []byte(dnskey.PrivateKeyString(priv)), 0600)
+	if err != nil {
+		t.Fatalf("error writing private key: %v", err)
+	}
+	return base
+}
+
+// verifyRRSIGs verifies that every RRset in rrs, other than the OPT
+// pseudo-RR, is covered by a valid RRSIG made with key.
+func verifyRRSIGs(t *testing.T, key *dns.DNSKEY, rrs []dns.RR) {
+	t.Helper()
+	rrsets := make(map[uint16][]dns.RR)
+	sigs := make(map[uint16]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[sig.TypeCovered] = sig
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+	}
+	for rrtype, rrset := range rrsets {
+		sig, ok := sigs[rrtype]
+		if !ok {
+			t.Errorf("missing RRSIG for %s RRset", dns.TypeToString[rrtype])
+			continue
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			t.Errorf("invalid RRSIG for %s RRset: %v", dns.TypeToString[rrtype], err)
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("RRSIG for %s RRset is not currently valid", dns.TypeToString[rrtype])
+		}
+	}
+}
+
+func TestDNSSEC(t *testing.T) {
+	base := writeDNSSECKey(t, t.TempDir(), "example.com.")
+	c := caddy.NewTestController("dns", fmt.Sprintf(`wgsd example.com. wg0 {
+		dnssec %s
+	}`, base))
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no errors, but got '%v'", err)
+	}
+	zone := zones.Z["example.com."]
+	if len(zone.keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(zone.keys))
+	}
+	key := zone.keys[0].dnskey
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`wgsd example.net. wg0 {
+		dnssec %s
+	}`, base))
+	_, err = parse(c)
+	if err == nil {
+		t.Fatal("expected error for key of another zone")
+	}
+
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	peer1Name := instanceName(&Zone{name: "example.com."}, peer1)
+	p := &WGSD{
+		Next:  test.ErrorHandler(),
+		Zones: zones,
+		client: &mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": {
+					Name:  "wg0",
+					Peers: []wgtypes.Peer{peer1},
+				},
+			},
+		},
+	}
+
+	serve := func(qname string, qtype uint16, do bool) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		m.SetEdns0(4096, do)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := p.ServeDNS(context.TODO(), rec, m)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return rec.Msg
+	}
+
+	t.Run("unsigned without DO", func(t *testing.T) {
+		resp := serve(peer1Name, dns.TypeSRV, false)
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			if _, ok := rr.(*dns.RRSIG); ok {
+				t.Fatalf("unexpected RRSIG: %s", rr)
+			}
+		}
+		resp = serve("nxdomain.example.com.", dns.TypeA, false)
+		if resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("expected NXDOMAIN, got %s", dns.RcodeToString[resp.Rcode])
+		}
+	})
+
+	t.Run("DNSKEY", func(t *testing.T) {
+		resp := serve("example.com.", dns.TypeDNSKEY, true)
+		if len(resp.Answer) != 2 {
+			t.Fatalf("expected DNSKEY and RRSIG, got %v", resp.Answer)
+		}
+		verifyRRSIGs(t, key, resp.Answer)
+	})
+
+	t.Run("SRV", func(t *testing.T) {
+		resp := serve(peer1Name, dns.TypeSRV, true)
+		if len(resp.Answer) != 2 {
+			t.Fatalf("expected SRV and RRSIG, got %v", resp.Answer)
+		}
+		verifyRRSIGs(t, key, resp.Answer)
+		if len(resp.Extra) != 5 {
+			t.Fatalf("expected A, TXT, RRSIGs, and OPT, got %v", resp.Extra)
+		}
+		verifyRRSIGs(t, key, resp.Extra)
+	})
+
+	t.Run("PTR", func(t *testing.T) {
+		resp := serve("_wireguard._udp.example.com.", dns.TypePTR, true)
+		verifyRRSIGs(t, key, resp.Answer)
+	})
+
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		resp := serve("nxdomain.example.com.", dns.TypeA, true)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("expected NOERROR, got %s", dns.RcodeToString[resp.Rcode])
+		}
+		verifyRRSIGs(t, key, resp.Ns)
+		var nsec *dns.NSEC
+		for _, rr := range resp.Ns {
+			if x, ok := rr.(*dns.NSEC); ok {
+				nsec = x
+			}
+		}
+		if nsec == nil {
+			t.Fatalf("missing NSEC in %v", resp.Ns)
+		}
+		if nsec.NextDomain != "\\000.nxdomain.example.com." {
+			t.Errorf("unexpected NSEC next domain: %s", nsec.NextDomain)
+		}
+		want := []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}
+		if fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint(want) {
+			t.Errorf("expected NSEC types %v, got %v", want, nsec.TypeBitMap)
+		}
+	})
+
+	t.Run("NODATA", func(t *testing.T) {
+		resp := serve(peer1Name, dns.TypeAAAA, true)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Fatalf("expected NODATA, got %v", resp)
+		}
+		verifyRRSIGs(t, key, resp.Ns)
+		var nsec *dns.NSEC
+		for _, rr := range resp.Ns {
+			if x, ok := rr.(*dns.NSEC); ok {
+				nsec = x
+			}
+		}
+		if nsec == nil {
+			t.Fatalf("missing NSEC in %v", resp.Ns)
+		}
+		want := []uint16{dns.TypeA, dns.TypeTXT, dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC}
+		if fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint(want) {
+			t.Errorf("expected NSEC types %v, got %v", want, nsec.TypeBitMap)
+		}
+	})
+}
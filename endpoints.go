@@ -0,0 +1,109 @@
+package wgsd
+
+import (
+	"net"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// familyEndpoints holds the most recent endpoint of a peer per address family.
+type familyEndpoints struct {
+	v4 *net.UDPAddr
+	v6 *net.UDPAddr
+}
+
+// endpointCache remembers the most recent endpoint per address family of each
+// peer of a zone. A WireGuard device only records the endpoint a peer was last
+// seen at, so without it a dual-stack peer would only be published with the
+// address family it last roamed over. It is updated with every snapshot of the
+// devices of the zone as the snapshot is retrieved, so that endpoints are not
+// missed between queries.
+type endpointCache struct {
+	mu        sync.Mutex
+	endpoints map[wgtypes.Key]*familyEndpoints
+	snapshots map[string]*deviceSnapshot // the snapshots last updated from by device name
+}
+
+// remember records endpoint as the most recent endpoint of its address family
+// for the peer with key.
+func (e *endpointCache) remember(key wgtypes.Key, endpoint *net.UDPAddr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rememberLocked(key, endpoint)
+}
+
+func (e *endpointCache) rememberLocked(key wgtypes.Key, endpoint *net.UDPAddr) {
+	if endpoint == nil {
+		return
+	}
+	if e.endpoints == nil {
+		e.endpoints = make(map[wgtypes.Key]*familyEndpoints)
+	}
+	f, ok := e.endpoints[key]
+	if !ok {
+		f = &familyEndpoints{}
+		e.endpoints[key] = f
+	}
+	if endpoint.IP.To4() != nil {
+		f.v4 = endpoint
+	} else {
+		f.v6 = endpoint
+	}
+}
+
+// update records the current endpoints of the peers of snapshot, a snapshot of
+// a single device, and forgets the endpoints of peers that are no longer
+// configured on any device of the zone. Repeated updates from the same
+// snapshot are no-ops.
+func (e *endpointCache) update(snapshot *deviceSnapshot) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	name := snapshot.device.Name
+	if snapshot == e.snapshots[name] {
+		return
+	}
+	if e.snapshots == nil {
+		e.snapshots = make(map[string]*deviceSnapshot)
+	}
+	e.snapshots[name] = snapshot
+	for _, peer := range snapshot.device.Peers {
+		e.rememberLocked(peer.PublicKey, peer.Endpoint)
+	}
+	for key := range e.endpoints {
+		configured := false
+		for _, s := range e.snapshots {
+			if _, ok := s.index[key]; ok || key == s.device.PublicKey {
+				configured = true
+				break
+			}
+		}
+		if !configured {
+			delete(e.endpoints, key)
+		}
+	}
+}
+
+// get returns the endpoints of peer: its current endpoint, followed by the most
+// recent endpoint of the other address family if one is known. It returns nil
+// if peer has no current endpoint.
+func (e *endpointCache) get(peer wgtypes.Peer) []*net.UDPAddr {
+	if peer.Endpoint == nil {
+		return nil
+	}
+	endpoints := []*net.UDPAddr{peer.Endpoint}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, ok := e.endpoints[peer.PublicKey]
+	if !ok {
+		return endpoints
+	}
+	if peer.Endpoint.IP.To4() != nil {
+		if f.v6 != nil {
+			endpoints = append(endpoints, f.v6)
+		}
+	} else if f.v4 != nil {
+		endpoints = append(endpoints, f.v4)
+	}
+	return endpoints
+}
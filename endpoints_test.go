@@ -0,0 +1,196 @@
+package wgsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDualStackEndpoints(t *testing.T) {
+	selfKey := [32]byte{}
+	selfKey[0] = 99
+	key1 := [32]byte{}
+	key1[0] = 1
+	endpoint4 := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 1}
+	endpoint6 := &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 1}
+	peer1 := wgtypes.Peer{
+		Endpoint:  endpoint4,
+		PublicKey: key1,
+	}
+	device := &wgtypes.Device{
+		Name:       "wg0",
+		PublicKey:  selfKey,
+		ListenPort: 51820,
+		Peers:      []wgtypes.Peer{peer1},
+	}
+	p := &WGSD{
+		Next: test.ErrorHandler(),
+		Zones: Zones{
+			Names: []string{"example.com."},
+			Z: map[string]*Zone{
+				"example.com.": {
+					name:      "example.com.",
+					devices:   []string{"wg0"},
+					ttl:       defaultTTLs,
+					serveSelf: true,
+				},
+			},
+		},
+		client: &mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": device,
+			},
+		},
+	}
+	peer1Name := instanceName(&Zone{name: "example.com."}, peer1)
+	selfName := instanceName(&Zone{name: "example.com."}, wgtypes.Peer{PublicKey: selfKey})
+
+	serve := func(w dns.ResponseWriter, qname string, qtype uint16) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		rec := dnstest.NewRecorder(w)
+		_, err := p.ServeDNS(context.TODO(), rec, m)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return rec.Msg
+	}
+	hostIPs := func(rrs []dns.RR) map[string]bool {
+		ips := make(map[string]bool)
+		for _, rr := range rrs {
+			switch x := rr.(type) {
+			case *dns.A:
+				ips[x.A.String()] = true
+			case *dns.AAAA:
+				ips[x.AAAA.String()] = true
+			}
+		}
+		return ips
+	}
+
+	resp := serve(&test.ResponseWriter{}, peer1Name, dns.TypeAAAA)
+	if len(resp.Answer) != 0 {
+		t.Fatalf("expected NODATA before roaming, got %v", resp.Answer)
+	}
+
+	// roam to IPv6
+	device.Peers[0].Endpoint = endpoint6
+	resp = serve(&test.ResponseWriter{}, peer1Name, dns.TypeA)
+	if ips := hostIPs(resp.Answer); len(ips) != 1 || !ips["1.1.1.1"] {
+		t.Errorf("expected remembered A 1.1.1.1, got %v", resp.Answer)
+	}
+	resp = serve(&test.ResponseWriter{}, peer1Name, dns.TypeAAAA)
+	if ips := hostIPs(resp.Answer); len(ips) != 1 || !ips["fd00::1"] {
+		t.Errorf("expected AAAA fd00::1, got %v", resp.Answer)
+	}
+	resp = serve(&test.ResponseWriter{}, peer1Name, dns.TypeSRV)
+	if ips := hostIPs(resp.Extra); len(ips) != 2 {
+		t.Errorf("expected A and AAAA in SRV additionals, got %v", resp.Extra)
+	}
+
+	// the local IP of a query is not served to later queries
+	serve(&test.ResponseWriter6{}, selfName, dns.TypeSRV)
+	resp = serve(&test.ResponseWriter{}, selfName, dns.TypeSRV)
+	if ips := hostIPs(resp.Extra); len(ips) != 1 || !ips["127.0.0.1"] {
+		t.Errorf("expected only the local IP of the query in SRV additionals, got %v", resp.Extra)
+	}
+
+	// configured self endpoints of both address families
+	zone := p.Z["example.com."]
+	zone.selfEndpoint = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	zone.selfAltEndpoint = &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820}
+	resp = serve(&test.ResponseWriter6{}, selfName, dns.TypeSRV)
+	if ips := hostIPs(resp.Extra); len(ips) != 2 || !ips["192.0.2.1"] || !ips["2001:db8::1"] {
+		t.Errorf("expected both configured self endpoints in SRV additionals, got %v", resp.Extra)
+	}
+
+	// remove the peer, forgetting its endpoints, and add it back
+	device.Peers = nil
+	serve(&test.ResponseWriter{}, peer1Name, dns.TypeA)
+	device.Peers = []wgtypes.Peer{{Endpoint: endpoint6, PublicKey: key1}}
+	resp = serve(&test.ResponseWriter{}, peer1Name, dns.TypeA)
+	if len(resp.Answer) != 0 {
+		t.Errorf("expected NODATA after re-adding peer, got %v", resp.Answer)
+	}
+}
+
+func TestDualStackEndpointsRefresh(t *testing.T) {
+	key1 := [32]byte{}
+	key1[0] = 1
+	device := &wgtypes.Device{
+		Name: "wg0",
+		Peers: []wgtypes.Peer{
+			{
+				Endpoint:  &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 1},
+				PublicKey: key1,
+			},
+		},
+	}
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg0": device,
+		},
+	}
+	zones := Zones{
+		Names: []string{"example.com."},
+		Z: map[string]*Zone{
+			"example.com.": {
+				name:            "example.com.",
+				devices:         []string{"wg0"},
+				ttl:             defaultTTLs,
+				refreshInterval: time.Hour,
+			},
+		},
+	}
+	p := &WGSD{
+		Next:       test.ErrorHandler(),
+		Zones:      zones,
+		client:     client,
+		refreshers: newDeviceRefreshers(client, zones),
+	}
+	r := p.refreshers["wg0"]
+
+	// roam from IPv6 to IPv4 between two refreshes, without queries
+	if err := r.refresh(context.Background()); err != nil {
+		t.Fatalf("error refreshing: %v", err)
+	}
+	client.devices["wg0"] = &wgtypes.Device{
+		Name: "wg0",
+		Peers: []wgtypes.Peer{
+			{
+				Endpoint:  &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 1},
+				PublicKey: key1,
+			},
+		},
+	}
+	if err := r.refresh(context.Background()); err != nil {
+		t.Fatalf("error refreshing: %v", err)
+	}
+
+	peer1Name := instanceName(&Zone{name: "example.com."}, wgtypes.Peer{PublicKey: key1})
+	m := new(dns.Msg)
+	m.SetQuestion(peer1Name, dns.TypeSRV)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := p.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ips := make(map[string]bool)
+	for _, rr := range rec.Msg.Extra {
+		switch x := rr.(type) {
+		case *dns.A:
+			ips[x.A.String()] = true
+		case *dns.AAAA:
+			ips[x.AAAA.String()] = true
+		}
+	}
+	if len(ips) != 2 || !ips["1.1.1.1"] || !ips["fd00::1"] {
+		t.Errorf("expected A and AAAA in SRV additionals, got %v", rec.Msg.Extra)
+	}
+}
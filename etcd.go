@@ -0,0 +1,556 @@
+package wgsd
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// etcdTimeout bounds connecting to etcd and the initial load of the
+	// prefix.
+	etcdTimeout = 5 * time.Second
+
+	// etcdRetryInterval is the interval at which a failed watch of the
+	// prefix is retried.
+	etcdRetryInterval = time.Second
+
+	// etcdMaxTxnOps is the maximum number of operations of a transaction,
+	// the default limit of etcd.
+	etcdMaxTxnOps = 128
+)
+
+// etcdSource is a PeerSource serving devices from an etcd key prefix, so that
+// wgsd replicas on several hosts serve the same peers from a shared store. A
+// device is stored at <prefix>/<device>, and each of its peers at
+// <prefix>/<device>/<peer>, as JSON encoded etcdDevice and etcdPeer values.
+// The prefix is watched, and every change is notified.
+type etcdSource struct {
+	client  *clientv3.Client
+	prefix  string // ends with a slash
+	cancel  context.CancelFunc
+	changes chan string
+	wake    chan struct{} // signals pending changes to deliver
+
+	mu      sync.Mutex
+	devices map[string]*etcdDeviceState // stored devices by name
+	pending map[string]bool             // names of changed devices not yet delivered
+	revs    map[string]int64            // mod revisions of the stored keys
+}
+
+// etcdDevice is the value stored for a device.
+type etcdDevice struct {
+	PublicKey  string `json:"public_key,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+}
+
+// etcdPeer is the value stored for a peer. The metadata fields are named after
+// the corresponding metadata TXT keys.
+type etcdPeer struct {
+	PublicKey  string   `json:"public_key"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+	Handshake  int64    `json:"handshake,omitempty"` // unix time of the last handshake
+	Keepalive  int      `json:"keepalive,omitempty"` // persistent keepalive interval in seconds
+	RX         int64    `json:"rx,omitempty"`
+	TX         int64    `json:"tx,omitempty"`
+	Protocol   int      `json:"proto,omitempty"`
+}
+
+// etcdDeviceState holds the stored values of a device.
+type etcdDeviceState struct {
+	info   *etcdDevice          // nil if only peers are stored
+	peers  map[string]*etcdPeer // peers by key
+	device *wgtypes.Device      // built from info and peers, nil after changes
+}
+
+// newEtcdSource returns an etcdSource for prefix of the etcd cluster at
+// endpoints. The prefix is loaded so that an unreachable cluster is rejected
+// early, and then watched until the source is closed.
+func newEtcdSource(prefix string, endpoints []string) (*etcdSource, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &etcdSource{
+		client:  client,
+		prefix:  strings.TrimSuffix(prefix, "/") + "/",
+		cancel:  cancel,
+		changes: make(chan string),
+		wake:    make(chan struct{}, 1),
+		devices: make(map[string]*etcdDeviceState),
+		pending: make(map[string]bool),
+		revs:    make(map[string]int64),
+	}
+	loadCtx, loadCancel := context.WithTimeout(ctx, etcdTimeout)
+	defer loadCancel()
+	rev, err := s.load(loadCtx)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error loading %s: %v", s.prefix, err)
+	}
+	go s.run(ctx, rev)
+	go s.deliver(ctx)
+	return s, nil
+}
+
+// Device returns the device name as stored in etcd.
+func (s *etcdSource) Device(_ context.Context, name string) (*wgtypes.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("no device %s in %s", name, s.prefix)
+	}
+	if state.device == nil {
+		state.device = state.build(name)
+	}
+	return state.device, nil
+}
+
+// Devices returns all devices stored in etcd.
+func (s *etcdSource) Devices(ctx context.Context) ([]*wgtypes.Device, error) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.devices))
+	for name := range s.devices {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	devices := make([]*wgtypes.Device, 0, len(names))
+	for _, name := range names {
+		device, err := s.Device(ctx, name)
+		if err != nil {
+			// deleted in the meantime
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// Changes returns the channel receiving the names of changed devices.
+func (s *etcdSource) Changes() <-chan string {
+	return s.changes
+}
+
+// Close stops watching the prefix and closes the etcd client.
+func (s *etcdSource) Close() error {
+	s.cancel()
+	return s.client.Close()
+}
+
+// load retrieves all values of the prefix, replacing the stored devices, and
+// returns the revision they were retrieved at. Devices that changed are not
+// notified, see reload.
+func (s *etcdSource) load(ctx context.Context) (int64, error) {
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = make(map[string]*etcdDeviceState)
+	s.revs = make(map[string]int64)
+	for _, kv := range resp.Kvs {
+		s.apply(string(kv.Key), kv.Value, kv.ModRevision, false)
+	}
+	return resp.Header.Revision, nil
+}
+
+// reload loads the prefix until it succeeds, notifying all devices stored
+// before or after, as changes may have been missed. It returns false if ctx was
+// canceled.
+func (s *etcdSource) reload(ctx context.Context) (int64, bool) {
+	changed := make(map[string]bool)
+	s.mu.Lock()
+	for name := range s.devices {
+		changed[name] = true
+	}
+	s.mu.Unlock()
+	for {
+		rev, err := s.load(ctx)
+		if err == nil {
+			s.mu.Lock()
+			for name := range s.devices {
+				changed[name] = true
+			}
+			s.mu.Unlock()
+			s.notify(changed)
+			return rev, ctx.Err() == nil
+		}
+		logger.Errorf("error loading %s: %v", s.prefix, err)
+		select {
+		case <-ctx.Done():
+			return 0, false
+		case <-time.After(etcdRetryInterval):
+		}
+	}
+}
+
+// run watches the prefix for changes after rev until ctx is canceled. If the
+// watch fails, e.g. as rev was compacted, the prefix is loaded again.
+func (s *etcdSource) run(ctx context.Context, rev int64) {
+	for {
+		err := s.watch(ctx, rev)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Errorf("error watching %s: %v", s.prefix, err)
+		var ok bool
+		if rev, ok = s.reload(ctx); !ok {
+			return
+		}
+	}
+}
+
+// watch applies the changes of the prefix after rev until the watch fails.
+func (s *etcdSource) watch(ctx context.Context, rev int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watch := s.client.Watch(clientv3.WithRequireLeader(ctx), s.prefix,
+		clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for resp := range watch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		changed := make(map[string]bool)
+		s.mu.Lock()
+		for _, ev := range resp.Events {
+			device, ok := s.apply(string(ev.Kv.Key), ev.Kv.Value,
+				ev.Kv.ModRevision, ev.Type == clientv3.EventTypeDelete)
+			if ok {
+				changed[device] = true
+			}
+		}
+		s.mu.Unlock()
+		s.notify(changed)
+	}
+	return fmt.Errorf("watch closed")
+}
+
+// notify queues the names of the changed devices for delivery on the changes
+// channel. It does not block, so that a slow or absent reader does not stall
+// the watch. Devices changing again before they are delivered are only
+// delivered once.
+func (s *etcdSource) notify(changed map[string]bool) {
+	if len(changed) == 0 {
+		return
+	}
+	s.mu.Lock()
+	for name := range changed {
+		s.pending[name] = true
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the names of the pending changed devices on the changes channel
+// until ctx is canceled.
+func (s *etcdSource) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		}
+		s.mu.Lock()
+		names := make([]string, 0, len(s.pending))
+		for name := range s.pending {
+			names = append(names, name)
+		}
+		s.pending = make(map[string]bool)
+		s.mu.Unlock()
+		sort.Strings(names)
+		for _, name := range names {
+			select {
+			case s.changes <- name:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// apply stores, or deletes, the value of key modified at rev, returning the name
+// of the device it belongs to. Invalid values are logged and ignored. s.mu must
+// be held.
+func (s *etcdSource) apply(key string, value []byte, rev int64, deleted bool) (string, bool) {
+	if deleted {
+		delete(s.revs, key)
+	} else {
+		s.revs[key] = rev
+	}
+	name, peer, isPeer := strings.Cut(strings.TrimPrefix(key, s.prefix), "/")
+	if name == "" || (isPeer && peer == "") {
+		return "", false
+	}
+	state, ok := s.devices[name]
+	if !ok {
+		if deleted {
+			return "", false
+		}
+		state = &etcdDeviceState{peers: make(map[string]*etcdPeer)}
+		s.devices[name] = state
+	}
+	state.device = nil
+	switch {
+	case deleted && isPeer:
+		delete(state.peers, key)
+	case deleted:
+		state.info = nil
+	case isPeer:
+		var p etcdPeer
+		if err := json.Unmarshal(value, &p); err != nil {
+			logger.Errorf("invalid peer %s: %v", key, err)
+			delete(state.peers, key)
+			break
+		}
+		state.peers[key] = &p
+	default:
+		var d etcdDevice
+		if err := json.Unmarshal(value, &d); err != nil {
+			logger.Errorf("invalid device %s: %v", key, err)
+			state.info = nil
+			break
+		}
+		state.info = &d
+	}
+	if state.info == nil && len(state.peers) == 0 {
+		delete(s.devices, name)
+	}
+	return name, true
+}
+
+// build returns the device name of the stored values, with its peers ordered
+// by key. Invalid peers are logged and left out.
+func (d *etcdDeviceState) build(name string) *wgtypes.Device {
+	device := &wgtypes.Device{Name: name}
+	if d.info != nil {
+		key, err := wgtypes.ParseKey(d.info.PublicKey)
+		if err != nil && d.info.PublicKey != "" {
+			logger.Errorf("invalid public key of device %s: %v", name, err)
+		}
+		device.PublicKey = key
+		device.ListenPort = d.info.ListenPort
+	}
+	keys := make([]string, 0, len(d.peers))
+	for key := range d.peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		peer, err := d.peers[key].peer()
+		if err != nil {
+			logger.Errorf("invalid peer %s: %v", key, err)
+			continue
+		}
+		device.Peers = append(device.Peers, peer)
+	}
+	return device
+}
+
+// newEtcdPeer returns the value stored for peer.
+func newEtcdPeer(peer wgtypes.Peer) *etcdPeer {
+	p := &etcdPeer{
+		PublicKey: peer.PublicKey.String(),
+		Keepalive: int(peer.PersistentKeepaliveInterval.Seconds()),
+		RX:        peer.ReceiveBytes,
+		TX:        peer.TransmitBytes,
+		Protocol:  peer.ProtocolVersion,
+	}
+	if peer.Endpoint != nil {
+		p.Endpoint = peer.Endpoint.String()
+	}
+	for _, prefix := range peer.AllowedIPs {
+		p.AllowedIPs = append(p.AllowedIPs, prefix.String())
+	}
+	if !peer.LastHandshakeTime.IsZero() {
+		p.Handshake = peer.LastHandshakeTime.Unix()
+	}
+	return p
+}
+
+// peer returns the peer of the stored value. Endpoints must be in ip:port form,
+// as devices are built while queries wait, and resolving host names could
+// recurse into this server.
+func (p *etcdPeer) peer() (wgtypes.Peer, error) {
+	var peer wgtypes.Peer
+	var err error
+	peer.PublicKey, err = wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return peer, fmt.Errorf("invalid public_key: %v", err)
+	}
+	if p.Endpoint != "" {
+		endpoint, err := netip.ParseAddrPort(p.Endpoint)
+		if err != nil {
+			return peer, fmt.Errorf("invalid endpoint: %v", err)
+		}
+		peer.Endpoint = net.UDPAddrFromAddrPort(endpoint)
+	}
+	for _, s := range p.AllowedIPs {
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return peer, fmt.Errorf("invalid allowed_ips: %v", err)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+	}
+	if p.Handshake != 0 {
+		peer.LastHandshakeTime = time.Unix(p.Handshake, 0)
+	}
+	peer.PersistentKeepaliveInterval = time.Duration(p.Keepalive) * time.Second
+	peer.ReceiveBytes = p.RX
+	peer.TransmitBytes = p.TX
+	peer.ProtocolVersion = p.Protocol
+	return peer, nil
+}
+
+// sameAs returns true if p and o only differ in their transfer counters, which
+// change too often to be worth publishing on their own.
+func (p *etcdPeer) sameAs(o *etcdPeer) bool {
+	if p.PublicKey != o.PublicKey || p.Endpoint != o.Endpoint ||
+		p.Handshake != o.Handshake || p.Keepalive != o.Keepalive ||
+		p.Protocol != o.Protocol || len(p.AllowedIPs) != len(o.AllowedIPs) {
+		return false
+	}
+	for i := range p.AllowedIPs {
+		if p.AllowedIPs[i] != o.AllowedIPs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// peerKey returns the key of the peer with the public key of device.
+func (s *etcdSource) peerKey(device string, key wgtypes.Key) string {
+	return s.prefix + device + "/" + hex.EncodeToString(key[:])
+}
+
+// isPeerKey returns true if key is a key of a peer of device as returned by
+// peerKey, i.e. one that is written by publish.
+func (s *etcdSource) isPeerKey(device, key string) bool {
+	name, ok := strings.CutPrefix(key, s.prefix+device+"/")
+	if !ok || len(name) != hex.EncodedLen(wgtypes.KeyLen) {
+		return false
+	}
+	b, err := hex.DecodeString(name)
+	return err == nil && hex.EncodeToString(b) == name
+}
+
+// publish stores device and its peers. Replicas publishing the same device
+// observe different endpoints, so a peer is only stored if its handshake is
+// at least as recent as that of the stored peer. Stored peers under the keys
+// written by publish that are not configured on the device are deleted, even
+// if they were removed while wgsd was not running. Replicas must therefore
+// share the identity of the device, i.e. its public key and listen port, and
+// its peers; if the stored device differs from device nothing is published.
+//
+// The values are written in transactions that fail if any of the keys changed
+// since it was last watched, so that a concurrent write of another replica is
+// not overwritten with a stale value. They are published again at the next
+// interval.
+func (s *etcdSource) publish(ctx context.Context, device *wgtypes.Device) error {
+	var cmps []clientv3.Cmp
+	var ops []clientv3.Op
+	// add appends op for key, conditional on key not having changed.
+	add := func(key string, op clientv3.Op) {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", s.revs[key]))
+		ops = append(ops, op)
+	}
+	s.mu.Lock()
+	state := s.devices[device.Name]
+	info := &etcdDevice{
+		PublicKey:  device.PublicKey.String(),
+		ListenPort: device.ListenPort,
+	}
+	switch {
+	case state != nil && state.info != nil && *state.info != *info:
+		s.mu.Unlock()
+		return fmt.Errorf("device %s is stored with public key %s and listen "+
+			"port %d, replicas publishing it must share them", device.Name,
+			state.info.PublicKey, state.info.ListenPort)
+	case state == nil || state.info == nil:
+		value, err := json.Marshal(info)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		add(s.prefix+device.Name, clientv3.OpPut(s.prefix+device.Name, string(value)))
+	}
+	published := make(map[string]bool, len(device.Peers))
+	for _, peer := range device.Peers {
+		key := s.peerKey(device.Name, peer.PublicKey)
+		published[key] = true
+		p := newEtcdPeer(peer)
+		if state != nil {
+			stored, ok := state.peers[key]
+			if ok && (stored.Handshake > p.Handshake || stored.sameAs(p)) {
+				continue
+			}
+		}
+		value, err := json.Marshal(p)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		add(key, clientv3.OpPut(key, string(value)))
+	}
+	if state != nil {
+		var stale []string
+		for key := range state.peers {
+			if !published[key] && s.isPeerKey(device.Name, key) {
+				stale = append(stale, key)
+			}
+		}
+		sort.Strings(stale)
+		for _, key := range stale {
+			add(key, clientv3.OpDelete(key))
+		}
+	}
+	s.mu.Unlock()
+
+	// Transactions are limited in size, larger devices are written in
+	// batches, each of which is applied atomically.
+	for len(ops) > 0 {
+		n := min(len(ops), etcdMaxTxnOps)
+		resp, err := s.client.Txn(ctx).If(cmps[:n]...).Then(ops[:n]...).Commit()
+		if err != nil {
+			return err
+		}
+		if !resp.Succeeded {
+			return fmt.Errorf("device %s changed concurrently", device.Name)
+		}
+		cmps, ops = cmps[n:], ops[n:]
+	}
+	return nil
+}
+
+func init() {
+	RegisterPeerSource("etcd", func(_ string, args []string) (PeerSource, error) {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("etcd source requires a prefix and at least one endpoint")
+		}
+		source, err := newEtcdSource(args[0], args[1:])
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to etcd: %v", err)
+		}
+		return source, nil
+	})
+}
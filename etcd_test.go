@@ -0,0 +1,328 @@
+package wgsd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// startEtcd starts an embedded etcd server, returning its client endpoint.
+func startEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("error starting etcd: %v", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for etcd")
+	}
+	return e.Clients[0].Addr().String()
+}
+
+// waitChange waits for the change of device to be notified by s.
+func waitChange(t *testing.T, s *etcdSource, device string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case name := <-s.Changes():
+			if name == device {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for change of %s", device)
+		}
+	}
+}
+
+func TestEtcdSource(t *testing.T) {
+	endpoint := startEtcd(t)
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	key1, _ := wgtypes.ParseKey("xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=")
+	key2, _ := wgtypes.ParseKey("syKB97XhGnvC+kynh2KqQJPXoOoOpx/HmpMRTc+r4js=")
+	for key, value := range map[string]string{
+		"/wgsd/wg0":   `{"public_key":"` + key1.String() + `","listen_port":51820}`,
+		"/wgsd/wg0/a": `{"public_key":"` + key2.String() + `","endpoint":"192.0.2.1:51820","allowed_ips":["10.0.0.2/32"],"handshake":1600000000,"keepalive":25}`,
+		"/wgsd/wg0/b": `{"public_key":"invalid"}`,
+		"/wgsd/wg0/c": `{"public_key":"` + key1.String() + `","endpoint":"localhost:51820"}`,
+		"/wgsd/wg1/a": `not json`,
+		"/other/wg2":  `{}`,
+	} {
+		if _, err := client.Put(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source, err := newPeerSource("etcd", "example.com.", []string{"/wgsd", endpoint})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	s := source.(*etcdSource)
+	defer s.Close()
+
+	device, err := s.Device(ctx, "wg0")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if device.Name != "wg0" || device.PublicKey != key1 || device.ListenPort != 51820 {
+		t.Errorf("unexpected device %+v", device)
+	}
+	if len(device.Peers) != 1 {
+		t.Fatalf("expected 1 valid peer, got %v", device.Peers)
+	}
+	peer := device.Peers[0]
+	if peer.PublicKey != key2 || peer.Endpoint.String() != "192.0.2.1:51820" ||
+		len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0].String() != "10.0.0.2/32" ||
+		peer.LastHandshakeTime.Unix() != 1600000000 ||
+		peer.PersistentKeepaliveInterval != 25*time.Second {
+		t.Errorf("unexpected peer %+v", peer)
+	}
+	if _, err := s.Device(ctx, "wg1"); err == nil {
+		t.Error("expected error for device without valid values")
+	}
+	devices, _ := s.Devices(ctx)
+	if len(devices) != 1 {
+		t.Errorf("expected 1 device, got %v", devices)
+	}
+
+	// changes are watched and notified
+	if _, err := client.Put(ctx, "/wgsd/wg0/b", `{"public_key":"`+key1.String()+`"}`); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, s, "wg0")
+	device, _ = s.Device(ctx, "wg0")
+	if len(device.Peers) != 2 {
+		t.Errorf("expected 2 peers after put, got %v", device.Peers)
+	}
+	if _, err := client.Delete(ctx, "/wgsd/wg0", clientv3.WithPrefix()); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, s, "wg0")
+	if _, err := s.Device(ctx, "wg0"); err == nil {
+		t.Error("expected error for deleted device")
+	}
+}
+
+func TestEtcdNotify(t *testing.T) {
+	s := &etcdSource{
+		changes: make(chan string),
+		wake:    make(chan struct{}, 1),
+		pending: make(map[string]bool),
+	}
+	// changes are queued without a reader, coalescing duplicates
+	for i := 0; i < 10; i++ {
+		s.notify(map[string]bool{"wg0": true, "wg1": true})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.deliver(ctx)
+	var got []string
+	for len(got) < 2 {
+		select {
+		case name := <-s.changes:
+			got = append(got, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for changes, got %v", got)
+		}
+	}
+	if got[0] != "wg0" || got[1] != "wg1" {
+		t.Errorf("expected changes of wg0 and wg1, got %v", got)
+	}
+	select {
+	case name := <-s.changes:
+		t.Errorf("expected duplicate changes to be coalesced, got %s", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEtcdPublish(t *testing.T) {
+	endpoint := startEtcd(t)
+	ctx := context.Background()
+	s, err := newEtcdSource("/wgsd/", []string{endpoint})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer s.Close()
+	go func() {
+		// changes aren't of interest here
+		for range s.Changes() {
+		}
+	}()
+
+	key1, _ := wgtypes.ParseKey("xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=")
+	key2, _ := wgtypes.ParseKey("syKB97XhGnvC+kynh2KqQJPXoOoOpx/HmpMRTc+r4js=")
+	_, prefix, _ := net.ParseCIDR("10.0.0.2/32")
+	handshake := time.Unix(1600000000, 0)
+	local := &wgtypes.Device{
+		Name:       "wg0",
+		PublicKey:  key1,
+		ListenPort: 51820,
+		Peers: []wgtypes.Peer{
+			{
+				PublicKey:         key2,
+				Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820},
+				AllowedIPs:        []net.IPNet{*prefix},
+				LastHandshakeTime: handshake,
+			},
+		},
+	}
+	if err := s.publish(ctx, local); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	device, err := s.Device(ctx, "wg0")
+	for err != nil || len(device.Peers) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for published device, got %v, %v", device, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		device, err = s.Device(ctx, "wg0")
+	}
+	if device.PublicKey != key1 || device.Peers[0].Endpoint.String() != "192.0.2.1:51820" {
+		t.Errorf("unexpected published device %+v", device)
+	}
+
+	// another replica publishes a more recent handshake from another
+	// endpoint, which is not overwritten with the older local one
+	newer := newEtcdPeer(local.Peers[0])
+	newer.Endpoint = "198.51.100.1:51820"
+	newer.Handshake = handshake.Add(time.Minute).Unix()
+	value, _ := json.Marshal(newer)
+	if _, err := s.client.Put(ctx, s.peerKey("wg0", key2), string(value)); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		device, _ = s.Device(ctx, "wg0")
+		if device.Peers[0].Endpoint.String() == newer.Endpoint {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for peer of other replica")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.publish(ctx, local); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	resp, err := s.client.Get(ctx, s.peerKey("wg0", key2))
+	if err != nil || len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != string(value) {
+		t.Errorf("expected peer of other replica to be kept, got %v, %v", resp, err)
+	}
+
+	// a more recent handshake is not written over a concurrent write the
+	// watch has not observed yet
+	local.Peers[0].LastHandshakeTime = handshake.Add(time.Hour)
+	s.mu.Lock()
+	rev := s.revs[s.peerKey("wg0", key2)]
+	s.revs[s.peerKey("wg0", key2)] = rev - 1
+	s.mu.Unlock()
+	if err := s.publish(ctx, local); err == nil {
+		t.Error("expected error publishing over a concurrent write")
+	}
+	resp, err = s.client.Get(ctx, s.peerKey("wg0", key2))
+	if err != nil || len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != string(value) {
+		t.Errorf("expected concurrent write to be kept, got %v, %v", resp, err)
+	}
+	s.mu.Lock()
+	s.revs[s.peerKey("wg0", key2)] = rev
+	s.mu.Unlock()
+
+	// replicas must share the identity of the device
+	other := &wgtypes.Device{Name: "wg0", PublicKey: key2, ListenPort: 51820}
+	if err := s.publish(ctx, other); err == nil {
+		t.Error("expected error publishing device of another identity")
+	}
+	resp, err = s.client.Get(ctx, "/wgsd/wg0")
+	if err != nil || len(resp.Kvs) != 1 ||
+		string(resp.Kvs[0].Value) != `{"public_key":"`+key1.String()+`","listen_port":51820}` {
+		t.Errorf("expected stored device to be kept, got %v, %v", resp, err)
+	}
+
+	// peers removed from the local device are deleted, also by a replica
+	// started after their removal, while peers stored under other names are
+	// kept
+	manual := `{"public_key":"` + key1.String() + `"}`
+	if _, err := s.client.Put(ctx, "/wgsd/wg0/manual", manual); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := newEtcdSource("/wgsd/", []string{endpoint})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer restarted.Close()
+	local.Peers = nil
+	if err := restarted.publish(ctx, local); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	resp, err = s.client.Get(ctx, s.peerKey("wg0", key2))
+	if err != nil || len(resp.Kvs) != 0 {
+		t.Errorf("expected removed peer to be deleted, got %v, %v", resp, err)
+	}
+	resp, err = s.client.Get(ctx, "/wgsd/wg0/manual")
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Errorf("expected peer under another name to be kept, got %v, %v", resp, err)
+	}
+}
+
+func TestEtcdSetup(t *testing.T) {
+	endpoint := startEtcd(t)
+	c := caddy.NewTestController("dns", `wgsd example.com. wg0 {
+		source etcd /wgsd `+endpoint+`
+		publish 10s
+	}`)
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	zone := zones.Z["example.com."]
+	if zone.publishInterval != 10*time.Second {
+		t.Errorf("expected publish interval of 10s, got %v", zone.publishInterval)
+	}
+	zone.client.(*etcdSource).Close()
+
+	for _, input := range []string{
+		`wgsd example.com. wg0 {
+			source etcd /wgsd
+		}`,
+		`wgsd example.com. wg0 {
+			publish
+		}`,
+		`wgsd example.com. wg0 {
+			source etcd /wgsd ` + endpoint + `
+			publish 0s
+		}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if zones, err := parse(c); err == nil {
+			t.Errorf("expected error for %s", input)
+			zones.Z["example.com."].client.(*etcdSource).Close()
+		}
+	}
+}
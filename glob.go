@@ -0,0 +1,177 @@
+package wgsd
+
+import (
+	"context"
+	"crypto/sha256"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultDiscoverInterval is the interval at which the devices matching the
+// device pattern of a zone are discovered, unless refresh is enabled.
+const defaultDiscoverInterval = 5 * time.Second
+
+// isGlob returns true if device is a pattern matching device names rather than
+// a device name.
+func isGlob(device string) bool {
+	return strings.ContainsAny(device, "*?[\\")
+}
+
+// validGlob returns true if pattern is a valid device pattern, in the syntax of
+// path.Match.
+func validGlob(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// validDeviceLabel returns true if device may be served as the label of a
+// sub-zone.
+func validDeviceLabel(device string) bool {
+	if device == "" || strings.Contains(device, ".") {
+		return false
+	}
+	_, ok := dns.IsDomainName(device)
+	return ok
+}
+
+// subZones holds the sub-zones of a zone with a device pattern, one for each
+// matching device.
+type subZones struct {
+	mu    sync.RWMutex
+	zones map[string]*Zone // sub-zones by lowercase device name
+}
+
+// subZone returns the sub-zone of zone that name, relative to zone, belongs to,
+// and name relative to the sub-zone. It returns nil if name does not belong to
+// the sub-zone of a discovered device.
+func (z *Zone) subZone(name string) (*Zone, string) {
+	trimmed := strings.TrimSuffix(name, ".")
+	if trimmed == "" {
+		return nil, ""
+	}
+	label := trimmed[strings.LastIndex(trimmed, ".")+1:]
+	z.sub.mu.RLock()
+	defer z.sub.mu.RUnlock()
+	sub, ok := z.sub.zones[strings.ToLower(label)]
+	if !ok {
+		return nil, ""
+	}
+	return sub, strings.TrimSuffix(name, label+".")
+}
+
+// newSubZone returns the sub-zone of zone serving device. Sub-zones share the
+// configuration of zone, including the configured SOA nameserver and mailbox.
+// Device tags are disabled for devices whose name is not a valid tag.
+func (z *Zone) newSubZone(device string) *Zone {
+	return &Zone{
+		name:            strings.ToLower(device) + "." + z.name,
+		devices:         []string{device},
+		serveSelf:       z.serveSelf,
+		selfEndpoint:    z.selfEndpoint,
+		selfAltEndpoint: z.selfAltEndpoint,
+		selfAllowedIPs:  z.selfAllowedIPs,
+		soaNS:           z.soaNS,
+		soaMbox:         z.soaMbox,
+		ttl:             z.ttl,
+		refreshInterval: z.refreshInterval,
+		tsigKey:         z.tsigKey,
+		tsigSecret:      z.tsigSecret,
+		client:          z.client,
+		tags:            z.tags,
+		metadata:        z.metadata,
+		names:           z.names,
+		nameKeys:        z.nameKeys,
+		keyEncoding:     z.keyEncoding,
+		hosts:           z.hosts,
+		deviceTags:      z.deviceTags && validTag(strings.ToLower(device)),
+	}
+}
+
+// discover retrieves all devices, adding a sub-zone of zone for every device
+// matching its device pattern, and removing the sub-zones of devices that no
+// longer exist. If refresh is enabled the sub-zones are served from the
+// devices retrieved. The serial of zone is bumped when its sub-zones change.
+func (z *Zone) discover(ctx context.Context, client PeerSource) error {
+	devices, err := client.Devices(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+	z.sub.mu.Lock()
+	defer z.sub.mu.Unlock()
+	zones := make(map[string]*Zone)
+	for _, device := range devices {
+		if ok, _ := path.Match(z.glob, device.Name); !ok ||
+			!validDeviceLabel(device.Name) {
+			continue
+		}
+		key := strings.ToLower(device.Name)
+		if _, ok := zones[key]; ok {
+			// device names only differing in case share a label
+			continue
+		}
+		sub, ok := z.sub.zones[key]
+		if !ok || sub.devices[0] != device.Name {
+			sub = z.newSubZone(device.Name)
+			if z.refreshInterval > 0 {
+				sub.refresher = &deviceRefresher{
+					client:    client,
+					device:    device.Name,
+					endpoints: []*endpointCache{&sub.endpoints},
+				}
+			}
+			logger.Infof("serving device %s at %s", device.Name, sub.name)
+			if z.deviceTags && !sub.deviceTags {
+				logger.Warningf("device name %s is not a valid tag, "+
+					"its peers are not tagged", device.Name)
+			}
+		}
+		if sub.refresher != nil {
+			sub.refresher.store(newDeviceSnapshot(device))
+		}
+		zones[key] = sub
+	}
+	for key, sub := range z.sub.zones {
+		if _, ok := zones[key]; !ok {
+			logger.Infof("no longer serving %s", sub.name)
+		}
+	}
+	z.sub.zones = zones
+	z.serial.update(fingerprintSubZones(zones))
+	return nil
+}
+
+// fingerprintSubZones returns a digest of the names of zones.
+func fingerprintSubZones(zones map[string]*Zone) [sha256.Size]byte {
+	names := make([]string, 0, len(zones))
+	for _, sub := range zones {
+		names = append(names, sub.name)
+	}
+	sort.Strings(names)
+	return sha256.Sum256([]byte(strings.Join(names, "\n")))
+}
+
+// runDiscovery discovers devices every interval until ctx is canceled.
+func (z *Zone) runDiscovery(ctx context.Context, client PeerSource,
+	interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := z.discover(ctx, client); err != nil {
+			logger.Errorf("error discovering devices for zone %s: %v",
+				z.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDeviceGlob(t *testing.T) {
+	c := caddy.NewTestController("dns", `wgsd example.com. wg-site-* {
+		refresh
+	}`)
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no errors, but got '%v'", err)
+	}
+
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	key2 := [32]byte{}
+	key2[0] = 2
+	peer2 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("2.2.2.2"),
+			Port: 2,
+		},
+		PublicKey: key2,
+	}
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg-site-A": {
+				Name:  "wg-site-A",
+				Peers: []wgtypes.Peer{peer1},
+			},
+			"wg-site-b": {
+				Name:  "wg-site-b",
+				Peers: []wgtypes.Peer{peer2},
+			},
+			"wg0": {
+				Name:  "wg0",
+				Peers: []wgtypes.Peer{peer1, peer2},
+			},
+		},
+	}
+	p := &WGSD{
+		Next:   test.ErrorHandler(),
+		Zones:  zones,
+		client: client,
+	}
+	zone := zones.Z["example.com."]
+	if err := zone.discover(context.Background(), client); err != nil {
+		t.Fatalf("error discovering devices: %v", err)
+	}
+	siteA, _ := zone.subZone("wg-site-a.")
+	siteB, _ := zone.subZone("wg-site-b.")
+	if siteA == nil || siteB == nil {
+		t.Fatalf("expected sub-zones for wg-site-A and wg-site-b, got %v", zone.sub.zones)
+	}
+	serial := zone.serial.get()
+	if serial == 0 {
+		t.Error("expected non-zero serial of the parent zone")
+	}
+	peer1Name := instanceName(siteA, peer1)
+	peer2Name := instanceName(siteB, peer2)
+
+	testCases := []test.Case{
+		{
+			Qname: "example.com.",
+			Qtype: dns.TypeSOA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SOA(soa(zone).String()),
+			},
+		},
+		{
+			Qname: "wg-site-a.example.com.",
+			Qtype: dns.TypeSOA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SOA(soa(siteA).String()),
+			},
+		},
+		{
+			Qname: "_wireguard._udp.WG-SITE-A.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_wireguard._udp.wg-site-a.example.com. 0 IN PTR %s", peer1Name)),
+			},
+		},
+		{
+			Qname: "_wireguard._udp.wg-site-b.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_wireguard._udp.wg-site-b.example.com. 0 IN PTR %s", peer2Name)),
+			},
+		},
+		{
+			Qname: peer2Name,
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 2.2.2.2", peer2Name)),
+			},
+		},
+		{
+			// wg0 does not match the device pattern
+			Qname: "_wireguard._udp.wg0.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(zone).String()),
+			},
+		},
+	}
+	serve := func(tc test.Case) {
+		t.Run(fmt.Sprintf("%s %s", tc.Qname, dns.TypeToString[tc.Qtype]), func(t *testing.T) {
+			m := tc.Msg()
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := p.ServeDNS(context.TODO(), rec, m)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			resp := rec.Msg
+			if err := test.Header(tc, resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.Section(tc, test.Answer, resp.Answer); err != nil {
+				t.Error(err)
+			}
+			if err := test.Section(tc, test.Ns, resp.Ns); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	for _, tc := range testCases {
+		serve(tc)
+	}
+
+	// sub-zones are served from the discovered devices
+	client.devices["wg-site-b"] = &wgtypes.Device{Name: "wg-site-b"}
+	delete(client.devices, "wg-site-A")
+	if err := zone.discover(context.Background(), client); err != nil {
+		t.Fatalf("error discovering devices: %v", err)
+	}
+	if sub, _ := zone.subZone("wg-site-b."); sub != siteB {
+		t.Error("expected sub-zone of wg-site-b to be retained")
+	}
+	if zone.serial.get() == serial {
+		t.Error("expected serial of the parent zone to change with its sub-zones")
+	}
+	serve(test.Case{
+		Qname: "_wireguard._udp.wg-site-a.example.com.",
+		Qtype: dns.TypePTR,
+		Rcode: dns.RcodeNameError,
+		Ns: []dns.RR{
+			test.SOA(soa(zone).String()),
+		},
+	})
+	serve(test.Case{
+		Qname: "_wireguard._udp.wg-site-b.example.com.",
+		Qtype: dns.TypePTR,
+		Rcode: dns.RcodeSuccess,
+	})
+}
+
+func TestDeviceGlobTags(t *testing.T) {
+	c := caddy.NewTestController("dns", `wgsd example.com. wg* {
+		devicetags
+	}`)
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no errors, but got '%v'", err)
+	}
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg1":     {Name: "wg1"},
+			"wg_Site": {Name: "wg_Site"},
+		},
+	}
+	zone := zones.Z["example.com."]
+	if err := zone.discover(context.Background(), client); err != nil {
+		t.Fatalf("error discovering devices: %v", err)
+	}
+	wg1, _ := zone.subZone("wg1.")
+	site, _ := zone.subZone("wg_site.")
+	if wg1 == nil || site == nil {
+		t.Fatalf("expected sub-zones for wg1 and wg_Site, got %v", zone.sub.zones)
+	}
+	if !wg1.deviceTags {
+		t.Error("expected device tags for wg1")
+	}
+	if site.deviceTags {
+		t.Error("expected no device tags for wg_Site, which is not a valid tag")
+	}
+}
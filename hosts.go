@@ -0,0 +1,100 @@
+package wgsd
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// isHostName returns true if name, relative to the zone, is a single label, as
+// used for the tunnel host names of peers.
+func isHostName(name string) bool {
+	label := strings.TrimSuffix(name, ".")
+	return label != "" && !strings.Contains(label, ".")
+}
+
+// hostNames returns the tunnel host names of peer in zone: its public key in
+// the key encoding of zone, and its friendly name if it has one.
+func hostNames(zone *Zone, peer wgtypes.Peer) []string {
+	names := []string{zone.keyEncoding.encode(peer.PublicKey) + "." + zone.name}
+	if name, ok := zone.names[peer.PublicKey]; ok {
+		names = append(names, name+"."+zone.name)
+	}
+	return names
+}
+
+// getTunnelHostRRs returns the A and AAAA RRs for the host-length allowed IPs,
+// i.e. /32 and /128 prefixes, of peer.
+func getTunnelHostRRs(zone *Zone, name string, peer wgtypes.Peer) []dns.RR {
+	var rrs []dns.RR
+	for _, prefix := range peer.AllowedIPs {
+		ones, bits := prefix.Mask.Size()
+		if ones != bits {
+			continue
+		}
+		if ip := prefix.IP.To4(); ip != nil && bits == 8*len(ip) {
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    zone.ttl.host,
+				},
+				A: ip,
+			})
+			continue
+		}
+		rrs = append(rrs, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    zone.ttl.host,
+			},
+			AAAA: prefix.IP.To16(),
+		})
+	}
+	return rrs
+}
+
+// handleTunnelHost handles queries for <name>.<zone>, where name is the encoded
+// public key or friendly name of a peer, if tunnel host names are enabled for zone. The
+// name exists if the peer has at least one host-length allowed IP.
+// Unlike findPeer, peers without an endpoint are found, as their tunnel
+// addresses are reachable once they connect.
+func handleTunnelHost(state request.Request, zone *Zone, peers *peerSet) (int, error) {
+	if !zone.hosts {
+		return nxDomain(state, zone)
+	}
+	label := state.QName()[:strings.Index(state.QName(), ".")]
+	peer, ok := lookupPeer(zone, label, peers)
+	if !ok {
+		return nxDomain(state, zone)
+	}
+	hostRRs := getTunnelHostRRs(zone, state.QName(), peer)
+	if len(hostRRs) == 0 {
+		return nxDomain(state, zone)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	present := make(map[uint16]bool)
+	for _, rr := range hostRRs {
+		if rr.Header().Rrtype == state.QType() {
+			m.Answer = append(m.Answer, rr)
+		}
+		present[rr.Header().Rrtype] = true
+	}
+	if len(m.Answer) == 0 {
+		var types []uint16
+		for rrtype := range present {
+			types = append(types, rrtype)
+		}
+		return noData(state, zone, types...)
+	}
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
+}
@@ -0,0 +1,193 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestTunnelHosts(t *testing.T) {
+	selfKey := [32]byte{}
+	selfKey[0] = 99
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	peer1.AllowedIPs, _ = constructAllowedIPs(t, []string{"10.0.0.1/32", "fd00::1/128", "192.168.1.0/24"})
+	key2 := [32]byte{}
+	key2[0] = 2
+	peer2 := wgtypes.Peer{
+		// no endpoint
+		PublicKey: key2,
+	}
+	peer2.AllowedIPs, _ = constructAllowedIPs(t, []string{"10.0.0.2/32"})
+	key3 := [32]byte{}
+	key3[0] = 3
+	peer3 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("3.3.3.3"),
+			Port: 3,
+		},
+		PublicKey: key3,
+	}
+	peer3.AllowedIPs, _ = constructAllowedIPs(t, []string{"192.168.3.0/24"})
+	selfAllowed, _ := constructAllowedIPs(t, []string{"10.0.0.254/32"})
+	p := &WGSD{
+		Next: test.ErrorHandler(),
+		Zones: Zones{
+			Names: []string{"example.com.", "example.net."},
+			Z: map[string]*Zone{
+				"example.com.": {
+					name:           "example.com.",
+					devices:        []string{"wg0"},
+					ttl:            defaultTTLs,
+					serveSelf:      true,
+					selfAllowedIPs: selfAllowed,
+					names: map[wgtypes.Key]string{
+						key1: "alice",
+					},
+					nameKeys: map[string]wgtypes.Key{
+						"alice": key1,
+					},
+					hosts: true,
+				},
+				"example.net.": {
+					name:    "example.net.",
+					devices: []string{"wg0"},
+					ttl:     defaultTTLs,
+				},
+			},
+		},
+		client: &mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": {
+					Name:       "wg0",
+					PublicKey:  selfKey,
+					ListenPort: 51820,
+					Peers:      []wgtypes.Peer{peer1, peer2, peer3},
+				},
+			},
+		},
+	}
+	peer1Host := hostNames(p.Z["example.com."], peer1)[0]
+	peer2Host := hostNames(p.Z["example.com."], peer2)[0]
+	peer3Host := hostNames(p.Z["example.com."], peer3)[0]
+	selfHost := hostNames(p.Z["example.com."], wgtypes.Peer{PublicKey: selfKey})[0]
+	zone := p.Z["example.com."]
+
+	testCases := []test.Case{
+		{
+			Qname: "alice.example.com.",
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.A("alice.example.com. 0 IN A 10.0.0.1"),
+			},
+		},
+		{
+			Qname: "alice.example.com.",
+			Qtype: dns.TypeAAAA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.AAAA("alice.example.com. 0 IN AAAA fd00::1"),
+			},
+		},
+		{
+			Qname: peer1Host,
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 10.0.0.1", peer1Host)),
+			},
+		},
+		{
+			Qname: "alice.example.com.",
+			Qtype: dns.TypeTXT,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(zone).String()),
+			},
+		},
+		{
+			Qname: peer2Host,
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 10.0.0.2", peer2Host)),
+			},
+		},
+		{
+			Qname: peer2Host,
+			Qtype: dns.TypeAAAA,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(zone).String()),
+			},
+		},
+		{
+			Qname: selfHost,
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 10.0.0.254", selfHost)),
+			},
+		},
+		{
+			// no host-length allowed IPs
+			Qname: peer3Host,
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(zone).String()),
+			},
+		},
+		{
+			Qname: "bob.example.com.",
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(zone).String()),
+			},
+		},
+		{
+			// hosts disabled
+			Qname: fmt.Sprintf("%sexample.net.", peer1Host[:len(peer1Host)-len("example.com.")]),
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.net."]).String()),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.Qname, dns.TypeToString[tc.Qtype]), func(t *testing.T) {
+			m := tc.Msg()
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := p.ServeDNS(context.TODO(), rec, m)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			resp := rec.Msg
+			if err := test.Header(tc, resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.Section(tc, test.Answer, resp.Answer); err != nil {
+				t.Error(err)
+			}
+			if err := test.Section(tc, test.Ns, resp.Ns); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
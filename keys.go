@@ -0,0 +1,89 @@
+package wgsd
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keyEncoding is an encoding of WireGuard public keys in DNS labels. Hex is not
+// supported, as a hex-encoded key exceeds the 63 byte label limit.
+type keyEncoding int
+
+const (
+	encodingBase32         keyEncoding = iota // padded base32, the default
+	encodingBase32NoPad                       // unpadded base32
+	encodingBase32Hex                         // padded base32 with the extended hex alphabet
+	encodingBase32HexNoPad                    // unpadded base32 with the extended hex alphabet
+	encodingBase64URL                         // unpadded base64 with the URL and filename safe alphabet
+)
+
+// keyEncodings maps the names used in the encoding option to keyEncodings.
+var keyEncodings = map[string]keyEncoding{
+	"base32":          encodingBase32,
+	"base32-nopad":    encodingBase32NoPad,
+	"base32hex":       encodingBase32Hex,
+	"base32hex-nopad": encodingBase32HexNoPad,
+	"base64url":       encodingBase64URL,
+}
+
+const (
+	keyLen            = 56 // the number of characters in a base32-encoded WireGuard public key
+	keyLenNoPad       = 52 // the number of characters in an unpadded base32-encoded WireGuard public key
+	keyLenBase64      = 44 // the number of characters in a base64-encoded WireGuard public key
+	keyLenBase64NoPad = 43 // the number of characters in an unpadded base64-encoded WireGuard public key
+)
+
+// encode returns the DNS label for key. Base32 encodings are lowercase.
+func (e keyEncoding) encode(key wgtypes.Key) string {
+	switch e {
+	case encodingBase32NoPad:
+		return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).
+			EncodeToString(key[:]))
+	case encodingBase32Hex:
+		return strings.ToLower(base32.HexEncoding.EncodeToString(key[:]))
+	case encodingBase32HexNoPad:
+		return strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).
+			EncodeToString(key[:]))
+	case encodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString(key[:])
+	default:
+		return strings.ToLower(base32.StdEncoding.EncodeToString(key[:]))
+	}
+}
+
+// parseKeyLabel returns the public keys that label may encode in any of the
+// supported encodings. Base32 labels are case-insensitive, but base64url labels
+// are not, so label must be in the case it was queried with.
+func parseKeyLabel(label string) []wgtypes.Key {
+	var encodings []interface {
+		DecodeString(string) ([]byte, error)
+	}
+	switch len(label) {
+	case keyLen:
+		label = strings.ToUpper(label)
+		encodings = append(encodings, base32.StdEncoding, base32.HexEncoding)
+	case keyLenNoPad:
+		label = strings.ToUpper(label)
+		encodings = append(encodings,
+			base32.StdEncoding.WithPadding(base32.NoPadding),
+			base32.HexEncoding.WithPadding(base32.NoPadding))
+	case keyLenBase64:
+		encodings = append(encodings, base64.URLEncoding)
+	case keyLenBase64NoPad:
+		encodings = append(encodings, base64.RawURLEncoding)
+	}
+	var keys []wgtypes.Key
+	for _, encoding := range encodings {
+		b, err := encoding.DecodeString(label)
+		if err != nil || len(b) != wgtypes.KeyLen {
+			continue
+		}
+		var key wgtypes.Key
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	return keys
+}
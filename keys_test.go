@@ -0,0 +1,144 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestKeyEncoding(t *testing.T) {
+	key, err := wgtypes.ParseKey("xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=")
+	if err != nil {
+		t.Fatalf("error parsing key: %v", err)
+	}
+	testCases := []struct {
+		encoding string
+		want     string
+	}{
+		{"base32", "yutrled535igkl7bdlerl6m4vjxsxm3uqqpl4nmsn27mt56ad4ha===="},
+		{"base32-nopad", "yutrled535igkl7bdlerl6m4vjxsxm3uqqpl4nmsn27mt56ad4ha"},
+		{"base32hex", "okjhb43trt86abv13b4hbucsl9nincrkggfbsdcidqvcjtu03s70===="},
+		{"base32hex-nopad", "okjhb43trt86abv13b4hbucsl9nincrkggfbsdcidqvcjtu03s70"},
+		{"base64url", "xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6-yffAHw4"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.encoding, func(t *testing.T) {
+			label := keyEncodings[tc.encoding].encode(key)
+			if label != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, label)
+			}
+			if !containsKey(parseKeyLabel(label), key) {
+				t.Errorf("failed to parse %s", label)
+			}
+			if tc.encoding != "base64url" {
+				if !containsKey(parseKeyLabel(strings.ToUpper(label)), key) {
+					t.Errorf("failed to parse uppercase %s", label)
+				}
+			} else if containsKey(parseKeyLabel(strings.ToLower(label)), key) {
+				t.Errorf("unexpected case-insensitive match of %s", label)
+			}
+		})
+	}
+
+	for _, label := range []string{"", "alice", strings.Repeat("1", keyLen)} {
+		if keys := parseKeyLabel(label); len(keys) != 0 {
+			t.Errorf("expected no keys for %s, got %v", label, keys)
+		}
+	}
+}
+
+func containsKey(keys []wgtypes.Key, key wgtypes.Key) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKeyEncodingQueries(t *testing.T) {
+	key1, _ := wgtypes.ParseKey("xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=")
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	p := &WGSD{
+		Next: test.ErrorHandler(),
+		Zones: Zones{
+			Names: []string{"example.com."},
+			Z: map[string]*Zone{
+				"example.com.": {
+					name:        "example.com.",
+					devices:     []string{"wg0"},
+					ttl:         defaultTTLs,
+					keyEncoding: encodingBase64URL,
+				},
+			},
+		},
+		client: &mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": {
+					Name:  "wg0",
+					Peers: []wgtypes.Peer{peer1},
+				},
+			},
+		},
+	}
+
+	serve := func(qname string, qtype uint16) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := p.ServeDNS(context.TODO(), rec, m)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return rec.Msg
+	}
+
+	resp := serve("_wireguard._udp.example.com.", dns.TypePTR)
+	want := "xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6-yffAHw4._wireguard._udp.example.com."
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.PTR).Ptr != want {
+		t.Fatalf("expected PTR to %s, got %v", want, resp.Answer)
+	}
+
+	// base64url is case-sensitive, so the SRV target and the owner names must
+	// keep the case of the PTR target for it to be resolvable
+	resp = serve(want, dns.TypeSRV)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != want {
+		t.Fatalf("expected SRV answer owned by %s, got %v", want, resp.Answer)
+	}
+	target := resp.Answer[0].(*dns.SRV).Target
+	if target != want {
+		t.Errorf("expected SRV target %s, got %s", want, target)
+	}
+	for _, rr := range resp.Extra {
+		if rr.Header().Name != want {
+			t.Errorf("expected additional owned by %s, got %v", want, rr)
+		}
+	}
+	resp = serve(target, dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 ||
+		resp.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("expected A 1.1.1.1 for SRV target %s, got %v", target, resp)
+	}
+
+	for name, encoding := range keyEncodings {
+		qname := fmt.Sprintf("%s._wireguard._udp.example.com.", encoding.encode(key1))
+		resp := serve(qname, dns.TypeSRV)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Errorf("expected SRV answer for %s name %s, got %v", name, qname, resp)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package wgsd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerMetadata is a set of optional peer metadata keys served in TXT RRs.
+type peerMetadata uint8
+
+const (
+	metadataHandshake peerMetadata = 1 << iota // handshake=<unix time of last handshake>
+	metadataKeepalive                          // keepalive=<persistent keepalive interval in seconds>
+	metadataTransfer                           // rx=<bytes received> tx=<bytes transmitted>
+	metadataProtocol                           // proto=<protocol version>
+
+	metadataAll = metadataHandshake | metadataKeepalive | metadataTransfer |
+		metadataProtocol
+)
+
+// parseMetadata returns the peerMetadata for the given names as used in the
+// metadata option.
+func parseMetadata(names []string) (peerMetadata, error) {
+	if len(names) == 0 {
+		return metadataAll, nil
+	}
+	var m peerMetadata
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "handshake":
+			m |= metadataHandshake
+		case "keepalive":
+			m |= metadataKeepalive
+		case "transfer":
+			m |= metadataTransfer
+		case "protocol":
+			m |= metadataProtocol
+		default:
+			return 0, fmt.Errorf("invalid metadata kind: %s", name)
+		}
+	}
+	return m, nil
+}
+
+// metadataTXT returns the metadata key/value pairs of peer enabled by m.
+// The handshake is omitted if the peer has never completed one, and the
+// protocol version if it is unknown.
+func metadataTXT(m peerMetadata, peer wgtypes.Peer) []string {
+	var txt []string
+	if m&metadataHandshake != 0 && !peer.LastHandshakeTime.IsZero() {
+		txt = append(txt, fmt.Sprintf("handshake=%d",
+			peer.LastHandshakeTime.Unix()))
+	}
+	if m&metadataKeepalive != 0 {
+		txt = append(txt, fmt.Sprintf("keepalive=%d",
+			int64(peer.PersistentKeepaliveInterval.Seconds())))
+	}
+	if m&metadataTransfer != 0 {
+		txt = append(txt,
+			fmt.Sprintf("rx=%d", peer.ReceiveBytes),
+			fmt.Sprintf("tx=%d", peer.TransmitBytes),
+		)
+	}
+	if m&metadataProtocol != 0 && peer.ProtocolVersion != 0 {
+		txt = append(txt, fmt.Sprintf("proto=%d", peer.ProtocolVersion))
+	}
+	return txt
+}
+
+// getMetadataTXTRR returns the TXT RR for peer including the metadata keys
+// enabled for zone. The metadata changes without the zone's serial changing,
+// so it is only served in responses to queries, and never in zone transfers.
+func getMetadataTXTRR(zone *Zone, name string, peer wgtypes.Peer, tags []string) *dns.TXT {
+	txt := getTXTRR(zone, name, peer, tags)
+	txt.Txt = append(txt.Txt, metadataTXT(zone.metadata, peer)...)
+	return txt
+}
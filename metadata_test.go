@@ -0,0 +1,141 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMetadata(t *testing.T) {
+	handshake := time.Unix(1700000000, 0)
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey:                   key1,
+		LastHandshakeTime:           handshake,
+		PersistentKeepaliveInterval: 25 * time.Second,
+		ReceiveBytes:                1024,
+		TransmitBytes:               2048,
+		ProtocolVersion:             1,
+	}
+	key2 := [32]byte{}
+	key2[0] = 2
+	peer2 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("2.2.2.2"),
+			Port: 2,
+		},
+		PublicKey: key2,
+	}
+
+	testCases := []struct {
+		name     string
+		metadata peerMetadata
+		peer     wgtypes.Peer
+		want     []string
+	}{
+		{
+			name:     "disabled",
+			metadata: 0,
+			peer:     peer1,
+			want:     nil,
+		},
+		{
+			name:     "all",
+			metadata: metadataAll,
+			peer:     peer1,
+			want: []string{
+				fmt.Sprintf("handshake=%d", handshake.Unix()),
+				"keepalive=25",
+				"rx=1024",
+				"tx=2048",
+				"proto=1",
+			},
+		},
+		{
+			name:     "handshake and transfer",
+			metadata: metadataHandshake | metadataTransfer,
+			peer:     peer1,
+			want: []string{
+				fmt.Sprintf("handshake=%d", handshake.Unix()),
+				"rx=1024",
+				"tx=2048",
+			},
+		},
+		{
+			name:     "no handshake",
+			metadata: metadataAll,
+			peer:     peer2,
+			want: []string{
+				"keepalive=0",
+				"rx=0",
+				"tx=0",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &WGSD{
+				Next: test.ErrorHandler(),
+				Zones: Zones{
+					Names: []string{"example.com."},
+					Z: map[string]*Zone{
+						"example.com.": {
+							name:     "example.com.",
+							devices:  []string{"wg0"},
+							ttl:      defaultTTLs,
+							metadata: tc.metadata,
+						},
+					},
+				},
+				client: &mockClient{
+					devices: map[string]*wgtypes.Device{
+						"wg0": {
+							Name:  "wg0",
+							Peers: []wgtypes.Peer{peer1, peer2},
+						},
+					},
+				},
+			}
+			name := instanceName(&Zone{name: "example.com."}, tc.peer)
+			base := getTXTRR(p.Z["example.com."], name, tc.peer, nil).Txt
+
+			for _, qtype := range []uint16{dns.TypeTXT, dns.TypeSRV} {
+				m := new(dns.Msg)
+				m.SetQuestion(name, qtype)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				_, err := p.ServeDNS(context.TODO(), rec, m)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				var txt *dns.TXT
+				for _, rr := range append(rec.Msg.Answer, rec.Msg.Extra...) {
+					if x, ok := rr.(*dns.TXT); ok {
+						txt = x
+					}
+				}
+				if txt == nil {
+					t.Fatalf("missing TXT in %s response: %v",
+						dns.TypeToString[qtype], rec.Msg)
+				}
+				want := fmt.Sprint(append(base, tc.want...))
+				if got := fmt.Sprint(txt.Txt); got != want {
+					t.Errorf("expected %s TXT %s, got %s",
+						dns.TypeToString[qtype], want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package wgsd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// readNames reads a file mapping public keys to friendly names. Every line
+// contains a Base64 public key followed by a name. Empty lines and lines
+// starting with # are ignored. Names are unique, case-insensitively.
+func readNames(path string) (map[wgtypes.Key]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[wgtypes.Key]string)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected public key and name", path, lineNum)
+		}
+		key, err := wgtypes.ParseKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid public key '%s': %v", path, lineNum, fields[0], err)
+		}
+		name := fields[1]
+		if !validName(name) {
+			return nil, fmt.Errorf("%s:%d: invalid name: %s", path, lineNum, name)
+		}
+		if _, ok := names[key]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate public key %s", path, lineNum, fields[0])
+		}
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("%s:%d: duplicate name %s", path, lineNum, name)
+		}
+		seen[strings.ToLower(name)] = true
+		names[key] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// validName returns true if name may be used as the friendly name of a peer.
+// Names must be valid hostname labels, i.e. letters, digits, and hyphens, not
+// starting or ending with a hyphen, so they can't be confused with the
+// underscore-prefixed DNS-SD names. Names that could be an encoded public key
+// are rejected.
+func validName(name string) bool {
+	if len(name) < 1 || len(name) > 63 || len(parseKeyLabel(name)) > 0 {
+		return false
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// friendlyInstanceName returns the DNS-SD service instance name of peer in zone
+// using its friendly name, or an empty string if it has none.
+func friendlyInstanceName(zone *Zone, peer wgtypes.Peer) string {
+	name, ok := zone.names[peer.PublicKey]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s.%s%s", name, spPrefix, zone.name)
+}
+
+// peerInstanceName returns the service instance name that PTR RRs of zone
+// target for peer: its friendly name if it has one, its encoded public key
+// otherwise.
+func peerInstanceName(zone *Zone, peer wgtypes.Peer) string {
+	if name := friendlyInstanceName(zone, peer); name != "" {
+		return name
+	}
+	return instanceName(zone, peer)
+}
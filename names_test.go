@@ -0,0 +1,231 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestReadNames(t *testing.T) {
+	const (
+		pub1 = "xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4="
+		pub2 = "syKB97XhGnvC+kynh2KqQJPXoOoOpx/HmpMRTc+r4js="
+	)
+	testCases := []struct {
+		name      string
+		content   string
+		shouldErr bool
+		want      map[string]string
+	}{
+		{
+			"valid",
+			fmt.Sprintf("# peers\n%s alice-laptop\n\n%s Bob\n", pub1, pub2),
+			false,
+			map[string]string{pub1: "alice-laptop", pub2: "Bob"},
+		},
+		{
+			"invalid name",
+			fmt.Sprintf("%s alice_laptop\n", pub1),
+			true,
+			nil,
+		},
+		{
+			"leading hyphen",
+			fmt.Sprintf("%s -alice\n", pub1),
+			true,
+			nil,
+		},
+		{
+			"invalid public key",
+			"xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6 alice\n",
+			true,
+			nil,
+		},
+		{
+			"missing name",
+			pub1 + "\n",
+			true,
+			nil,
+		},
+		{
+			"duplicate public key",
+			fmt.Sprintf("%s alice\n%s bob\n", pub1, pub1),
+			true,
+			nil,
+		},
+		{
+			"duplicate name",
+			fmt.Sprintf("%s alice\n%s ALICE\n", pub1, pub2),
+			true,
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "names")
+			if err := os.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatalf("error writing names: %v", err)
+			}
+			names, err := readNames(path)
+			if (err != nil) != tc.shouldErr {
+				t.Fatalf("expected error: %v, got: %v", tc.shouldErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(names) != len(tc.want) {
+				t.Fatalf("expected %d names, got %d", len(tc.want), len(names))
+			}
+			for pub, want := range tc.want {
+				key, _ := wgtypes.ParseKey(pub)
+				if names[key] != want {
+					t.Errorf("expected name %s for %s, got %s", want, pub, names[key])
+				}
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	key1 := [32]byte{}
+	key1[0] = 1
+	key2 := [32]byte{}
+	key2[0] = 2
+	path := filepath.Join(t.TempDir(), "names")
+	content := fmt.Sprintf("%s Alice-Laptop\n", wgtypes.Key(key1))
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("error writing names: %v", err)
+	}
+	c := caddy.NewTestController("dns", fmt.Sprintf(`wgsd example.com. wg0 {
+		names %s
+		reverse 10.0.0.0/24
+	}`, path))
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no errors, but got '%v'", err)
+	}
+
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	peer1.AllowedIPs, _ = constructAllowedIPs(t, []string{"10.0.0.1/32"})
+	peer2 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("2.2.2.2"),
+			Port: 2,
+		},
+		PublicKey: key2,
+	}
+	p := &WGSD{
+		Next:  test.ErrorHandler(),
+		Zones: zones,
+		client: &mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": {
+					Name:  "wg0",
+					Peers: []wgtypes.Peer{peer1, peer2},
+				},
+			},
+		},
+	}
+	peer1Name := "Alice-Laptop._wireguard._udp.example.com."
+	peer1b32Name := instanceName(&Zone{name: "example.com."}, peer1)
+	peer2Name := instanceName(&Zone{name: "example.com."}, peer2)
+	zone := p.Z["example.com."]
+
+	testCases := []test.Case{
+		{
+			Qname: "_wireguard._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s", peer1Name)),
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s", peer2Name)),
+			},
+		},
+		{
+			Qname: "alice-laptop._wireguard._udp.example.com.",
+			Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SRV("alice-laptop._wireguard._udp.example.com. 0 IN SRV 0 0 1 alice-laptop._wireguard._udp.example.com."),
+			},
+			Extra: []dns.RR{
+				test.A("alice-laptop._wireguard._udp.example.com. 0 IN A 1.1.1.1"),
+				getTXTRR(zone, "alice-laptop._wireguard._udp.example.com.", peer1, nil),
+			},
+		},
+		{
+			Qname: peer1b32Name,
+			Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SRV(fmt.Sprintf("%s 0 IN SRV 0 0 1 %s", peer1b32Name, peer1b32Name)),
+			},
+			Extra: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 1.1.1.1", peer1b32Name)),
+				getTXTRR(zone, peer1b32Name, peer1, nil),
+			},
+		},
+		{
+			Qname: peer1Name,
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 1.1.1.1", peer1Name)),
+			},
+		},
+		{
+			Qname: "bob._wireguard._udp.example.com.",
+			Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(zone).String()),
+			},
+		},
+		{
+			Qname: "1.0.0.10.in-addr.arpa.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("1.0.0.10.in-addr.arpa. 0 IN PTR %s", peer1Name)),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.Qname, dns.TypeToString[tc.Qtype]), func(t *testing.T) {
+			m := tc.Msg()
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := p.ServeDNS(context.TODO(), rec, m)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			resp := rec.Msg
+			if err := test.Header(tc, resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.Section(tc, test.Answer, resp.Answer); err != nil {
+				t.Error(err)
+			}
+			if err := test.Section(tc, test.Ns, resp.Ns); err != nil {
+				t.Error(err)
+			}
+			if err := test.Section(tc, test.Extra, resp.Extra); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
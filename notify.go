@@ -0,0 +1,58 @@
+package wgsd
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// notifier sends DNS NOTIFY messages for a zone. It is implemented by
+// *transfer.Transfer.
+type notifier interface {
+	Notify(zone string) error
+}
+
+// zoneWatcher polls the WireGuard devices of a zone and sends NOTIFY messages
+// whenever the zone's SOA serial changes.
+type zoneWatcher struct {
+	client     PeerSource
+	refreshers deviceRefreshers // snapshots shared with queries, may be nil
+	zone       *Zone
+	notifier   notifier
+	serial     uint32 // the serial last notified for
+}
+
+// poll retrieves the zone's devices and sends NOTIFY messages if the zone's
+// serial has changed since the last call.
+func (w *zoneWatcher) poll(ctx context.Context) {
+	snapshot, err := zoneSnapshot(ctx, w.client, w.refreshers, w.zone)
+	if err != nil {
+		logger.Errorf("error retrieving devices %s for zone %s: %v",
+			strings.Join(w.zone.devices, ","), w.zone.name, err)
+		return
+	}
+	serial := w.zone.serial.update(snapshot.fingerprint)
+	if serial == w.serial {
+		return
+	}
+	w.serial = serial
+	err = w.notifier.Notify(strings.ToLower(w.zone.name))
+	if err != nil {
+		logger.Warningf("error sending notify for zone %s: %v",
+			w.zone.name, err)
+	}
+}
+
+// run polls every interval until ctx is canceled.
+func (w *zoneWatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
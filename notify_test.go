@@ -0,0 +1,87 @@
+package wgsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type mockNotifier struct {
+	zones []string
+}
+
+func (m *mockNotifier) Notify(zone string) error {
+	m.zones = append(m.zones, zone)
+	return nil
+}
+
+func TestZoneWatcher(t *testing.T) {
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg0": {
+				Name:  "wg0",
+				Peers: []wgtypes.Peer{peer1},
+			},
+		},
+	}
+	n := &mockNotifier{}
+	w := &zoneWatcher{
+		client: client,
+		zone: &Zone{
+			name:    "Example.com.",
+			devices: []string{"wg0"},
+		},
+		notifier: n,
+	}
+
+	w.poll(context.Background())
+	if len(n.zones) != 1 || n.zones[0] != "example.com." {
+		t.Fatalf("expected initial notify for example.com., got %v", n.zones)
+	}
+	w.poll(context.Background())
+	if len(n.zones) != 1 {
+		t.Fatalf("expected no notify without peer changes, got %v", n.zones)
+	}
+
+	peer1.Endpoint = &net.UDPAddr{
+		IP:   net.ParseIP("1.1.1.2"),
+		Port: 1,
+	}
+	client.devices["wg0"].Peers = []wgtypes.Peer{peer1}
+	w.poll(context.Background())
+	if len(n.zones) != 2 {
+		t.Fatalf("expected notify after endpoint change, got %v", n.zones)
+	}
+
+	// the serial may have been bumped by a query in the meantime
+	w.zone.serial.update([32]byte{})
+	w.poll(context.Background())
+	if len(n.zones) != 3 {
+		t.Fatalf("expected notify after serial change, got %v", n.zones)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx, time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watcher to stop")
+	}
+}
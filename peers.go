@@ -0,0 +1,79 @@
+package wgsd
+
+import (
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerSet is the set of peers served for a zone in response to a query: the
+// peers of a device snapshot, and the local device if self is served.
+type peerSet struct {
+	snapshot *deviceSnapshot
+	self     *wgtypes.Peer // nil if self is not served
+}
+
+// get returns the peer with key.
+func (s *peerSet) get(key wgtypes.Key) (wgtypes.Peer, bool) {
+	if s.self != nil && s.self.PublicKey == key {
+		return *s.self, true
+	}
+	i, ok := s.snapshot.index[key]
+	if !ok {
+		return wgtypes.Peer{}, false
+	}
+	return s.snapshot.device.Peers[i], true
+}
+
+// origin returns the name of the device the peer with key is configured on.
+// The local device is the first device of the snapshot.
+func (s *peerSet) origin(key wgtypes.Key) string {
+	if origin, ok := s.snapshot.origins[key]; ok {
+		return origin
+	}
+	return s.snapshot.device.Name
+}
+
+// all returns all peers. The returned slice may be shared with the snapshot and
+// must not be modified.
+func (s *peerSet) all() []wgtypes.Peer {
+	if s.self == nil {
+		return s.snapshot.device.Peers
+	}
+	peers := make([]wgtypes.Peer, 0, len(s.snapshot.device.Peers)+1)
+	peers = append(peers, s.snapshot.device.Peers...)
+	return append(peers, *s.self)
+}
+
+// indexPeers returns the index of every peer in peers by public key.
+func indexPeers(peers []wgtypes.Peer) map[wgtypes.Key]int {
+	index := make(map[wgtypes.Key]int, len(peers))
+	for i, peer := range peers {
+		index[peer.PublicKey] = i
+	}
+	return index
+}
+
+// indexNames returns the public keys of peers by their lowercase friendly
+// name.
+func indexNames(names map[wgtypes.Key]string) map[string]wgtypes.Key {
+	keys := make(map[string]wgtypes.Key, len(names))
+	for key, name := range names {
+		keys[strings.ToLower(name)] = key
+	}
+	return keys
+}
+
+// lookupPeer returns the peer whose friendly name or encoded public key is
+// label. label must be in the case it was queried with, see parseKeyLabel.
+func lookupPeer(zone *Zone, label string, peers *peerSet) (wgtypes.Peer, bool) {
+	for _, key := range parseKeyLabel(label) {
+		if peer, ok := peers.get(key); ok {
+			return peer, true
+		}
+	}
+	if key, ok := zone.nameKeys[strings.ToLower(label)]; ok {
+		return peers.get(key)
+	}
+	return wgtypes.Peer{}, false
+}
@@ -0,0 +1,105 @@
+package wgsd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// deviceRefresher retrieves a WireGuard device every interval in the
+// background, so that queries are answered from the most recent snapshot
+// instead of retrieving the device each time.
+type deviceRefresher struct {
+	client    PeerSource
+	device    string
+	interval  time.Duration
+	endpoints []*endpointCache               // caches of the zones served from the device
+	snapshot  atomic.Pointer[deviceSnapshot] // nil until the first refresh succeeds
+}
+
+// refresh retrieves the device and replaces the snapshot. The previous
+// snapshot is kept if the device can't be retrieved.
+func (r *deviceRefresher) refresh(ctx context.Context) error {
+	device, err := r.client.Device(ctx, r.device)
+	if err != nil {
+		return err
+	}
+	r.store(newDeviceSnapshot(device))
+	return nil
+}
+
+// store updates the endpoint caches with snapshot, and then replaces the
+// snapshot, so that queries never see a snapshot the caches missed.
+func (r *deviceRefresher) store(snapshot *deviceSnapshot) {
+	for _, endpoints := range r.endpoints {
+		endpoints.update(snapshot)
+	}
+	r.snapshot.Store(snapshot)
+}
+
+// get returns the most recent snapshot, retrieving the device if there is none
+// yet, e.g. when queried before the refresher has started.
+func (r *deviceRefresher) get(ctx context.Context) (*deviceSnapshot, error) {
+	if s := r.snapshot.Load(); s != nil {
+		return s, nil
+	}
+	if err := r.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return r.snapshot.Load(), nil
+}
+
+// run refreshes every interval until ctx is canceled.
+func (r *deviceRefresher) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.refresh(ctx); err != nil {
+			logger.Errorf("error refreshing device %s: %v", r.device, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deviceRefreshers holds device refreshers by device name.
+type deviceRefreshers map[string]*deviceRefresher
+
+// newDeviceRefreshers returns a refresher for every device of zones with
+// refresh enabled that retrieve their devices from client. Zones sharing a
+// device share its refresher, which refreshes at the shortest of their
+// intervals. Zones with a source of their own are given refreshers of their
+// own.
+func newDeviceRefreshers(client PeerSource, zones Zones) deviceRefreshers {
+	refreshers := make(deviceRefreshers)
+	for _, name := range zones.Names {
+		zone := zones.Z[name]
+		if zone.refreshInterval == 0 {
+			continue
+		}
+		shared := refreshers
+		if zone.client != nil {
+			zone.refreshers = make(deviceRefreshers)
+			shared = zone.refreshers
+		}
+		for _, device := range zone.devices {
+			r, ok := shared[device]
+			if !ok {
+				r = &deviceRefresher{
+					client:   zoneClient(client, zone),
+					device:   device,
+					interval: zone.refreshInterval,
+				}
+				shared[device] = r
+			}
+			if zone.refreshInterval < r.interval {
+				r.interval = zone.refreshInterval
+			}
+			r.endpoints = append(r.endpoints, &zone.endpoints)
+		}
+	}
+	return refreshers
+}
@@ -0,0 +1,136 @@
+package wgsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// countingClient counts the calls to Device, failing them if err is set.
+type countingClient struct {
+	mockClient
+	calls int
+	err   error
+}
+
+func (c *countingClient) Device(ctx context.Context, d string) (*wgtypes.Device, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.mockClient.Device(ctx, d)
+}
+
+func TestDeviceRefresher(t *testing.T) {
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	client := &countingClient{
+		mockClient: mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": {
+					Name:  "wg0",
+					Peers: []wgtypes.Peer{peer1},
+				},
+			},
+		},
+	}
+	zones := Zones{
+		Names: []string{"example.com.", "example2.com."},
+		Z: map[string]*Zone{
+			"example.com.": {
+				name:            "example.com.",
+				devices:         []string{"wg0"},
+				ttl:             defaultTTLs,
+				refreshInterval: time.Minute,
+			},
+			"example2.com.": {
+				name:            "example2.com.",
+				devices:         []string{"wg0"},
+				ttl:             defaultTTLs,
+				refreshInterval: time.Hour,
+			},
+		},
+	}
+	p := &WGSD{
+		Next:       test.ErrorHandler(),
+		Zones:      zones,
+		client:     client,
+		refreshers: newDeviceRefreshers(client, zones),
+	}
+	if len(p.refreshers) != 1 || p.refreshers["wg0"].interval != time.Minute {
+		t.Fatalf("expected one refresher for wg0 every minute, got %v", p.refreshers)
+	}
+
+	serve := func(qname string) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypePTR)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := p.ServeDNS(context.TODO(), rec, m)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return rec.Msg
+	}
+
+	// queries before the first refresh retrieve the device once
+	for i := 0; i < 3; i++ {
+		for _, name := range zones.Names {
+			if resp := serve("_wireguard._udp." + name); len(resp.Answer) != 1 {
+				t.Fatalf("expected 1 PTR answer, got %v", resp.Answer)
+			}
+		}
+	}
+	if client.calls != 1 {
+		t.Fatalf("expected 1 device retrieval, got %d", client.calls)
+	}
+
+	// peer changes are served after the next refresh
+	client.devices["wg0"] = &wgtypes.Device{Name: "wg0"}
+	if resp := serve("_wireguard._udp.example.com."); len(resp.Answer) != 1 {
+		t.Fatalf("expected stale PTR answer, got %v", resp.Answer)
+	}
+	if err := p.refreshers["wg0"].refresh(context.Background()); err != nil {
+		t.Fatalf("error refreshing: %v", err)
+	}
+	if resp := serve("_wireguard._udp.example.com."); len(resp.Answer) != 0 {
+		t.Fatalf("expected no PTR answers, got %v", resp.Answer)
+	}
+
+	// the previous snapshot is kept on errors
+	client.err = errors.New("device error")
+	if err := p.refreshers["wg0"].refresh(context.Background()); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	snapshot, err := p.snapshot(context.Background(), zones.Z["example.com."])
+	if err != nil || snapshot.device != client.devices["wg0"] {
+		t.Fatalf("expected previous snapshot, got %v, %v", snapshot, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.refreshers["wg0"].run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresher did not stop")
+	}
+}
@@ -0,0 +1,183 @@
+package wgsd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	reverseSuffix4 = "in-addr.arpa."
+	reverseSuffix6 = "ip6.arpa."
+)
+
+// reverseZoneName returns the name of the reverse zone covering prefix. The
+// prefix length must be a multiple of 8 bits for IPv4, and 4 bits for IPv6, as
+// every label of a reverse name represents an octet or a nibble respectively.
+func reverseZoneName(prefix net.IPNet) (string, error) {
+	ones, bits := prefix.Mask.Size()
+	var labels []string
+	switch bits {
+	case 8 * net.IPv4len:
+		if ones%8 != 0 {
+			return "", fmt.Errorf("IPv4 prefix length must be a multiple of 8: %s", prefix.String())
+		}
+		ip := prefix.IP.To4()
+		for i := ones/8 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip[i])))
+		}
+		labels = append(labels, reverseSuffix4)
+	case 8 * net.IPv6len:
+		if ones%4 != 0 {
+			return "", fmt.Errorf("IPv6 prefix length must be a multiple of 4: %s", prefix.String())
+		}
+		ip := prefix.IP.To16()
+		for i := ones/4 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.FormatUint(uint64(nibble(ip, i)), 16))
+		}
+		labels = append(labels, reverseSuffix6)
+	default:
+		return "", fmt.Errorf("invalid prefix: %s", prefix.String())
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// nibble returns the i'th nibble of ip, most significant first.
+func nibble(ip net.IP, i int) byte {
+	if i%2 == 0 {
+		return ip[i/2] >> 4
+	}
+	return ip[i/2] & 0x0f
+}
+
+// reverseNamePrefix returns the prefix represented by the reverse name name,
+// e.g. 10.0.0.0/24 for 0.0.10.in-addr.arpa. The prefix is a single address
+// for a complete reverse name. ok is false if name is not a valid reverse
+// name.
+func reverseNamePrefix(name string) (prefix *net.IPNet, ok bool) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, "."+reverseSuffix4):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+reverseSuffix4))
+		if len(labels) > net.IPv4len {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || strconv.FormatUint(octet, 10) != label {
+				return nil, false
+			}
+			ip[len(labels)-1-i] = byte(octet)
+		}
+		return &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(8*len(labels), 8*net.IPv4len),
+		}, true
+	case strings.HasSuffix(name, "."+reverseSuffix6):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+reverseSuffix6))
+		if len(labels) > 2*net.IPv6len {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil, false
+			}
+			j := len(labels) - 1 - i
+			if j%2 == 0 {
+				ip[j/2] |= byte(n) << 4
+			} else {
+				ip[j/2] |= byte(n)
+			}
+		}
+		return &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(4*len(labels), 8*net.IPv6len),
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// sameFamily returns true if a and b are of the same address family.
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// findPeerByIP returns the published peer with the longest allowed IP prefix
+// containing ip.
+func findPeerByIP(ip net.IP, peers []wgtypes.Peer) (wgtypes.Peer, bool) {
+	var found wgtypes.Peer
+	longest := -1
+	for _, peer := range peers {
+		if peer.Endpoint == nil {
+			continue
+		}
+		for _, prefix := range peer.AllowedIPs {
+			if !sameFamily(prefix.IP, ip) || !prefix.Contains(ip) {
+				continue
+			}
+			if ones, _ := prefix.Mask.Size(); ones > longest {
+				found, longest = peer, ones
+			}
+		}
+	}
+	return found, longest >= 0
+}
+
+// getReverseHandlerFn returns the handlerFn for name, relative to the name of
+// a reverse zone.
+func getReverseHandlerFn(name string) handlerFn {
+	if name == "" {
+		return handleApex
+	}
+	return handleReverse
+}
+
+// handleReverse handles queries below the apex of a reverse zone. The reverse
+// name of an address contained in the allowed IPs of a peer owns a PTR RR
+// targeting the service instance name of the peer. Names of shorter prefixes
+// overlapping with allowed IPs of peers are empty non-terminals.
+func handleReverse(state request.Request, zone *Zone, peers *peerSet) (int, error) {
+	prefix, ok := reverseNamePrefix(state.Name())
+	if !ok {
+		return nxDomain(state, zone)
+	}
+	ones, bits := prefix.Mask.Size()
+	if ones < bits {
+		for _, peer := range peers.all() {
+			if peer.Endpoint == nil {
+				continue
+			}
+			for _, allowed := range peer.AllowedIPs {
+				if sameFamily(allowed.IP, prefix.IP) &&
+					(allowed.Contains(prefix.IP) || prefix.Contains(allowed.IP)) {
+					return noData(state, zone)
+				}
+			}
+		}
+		return nxDomain(state, zone)
+	}
+
+	peer, ok := findPeerByIP(prefix.IP, peers.all())
+	if !ok {
+		return nxDomain(state, zone)
+	}
+	if state.QType() != dns.TypePTR {
+		return noData(state, zone, dns.TypePTR)
+	}
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	m.Answer = append(m.Answer, getPTRRR(state.Name(),
+		peerInstanceName(zone.forward, peer), zone.ttl.ptr))
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
+}
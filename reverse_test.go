@@ -0,0 +1,239 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestReverseZoneName(t *testing.T) {
+	testCases := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", "10.in-addr.arpa.", false},
+		{"10.1.0.0/16", "1.10.in-addr.arpa.", false},
+		{"10.1.2.0/24", "2.1.10.in-addr.arpa.", false},
+		{"10.1.2.3/32", "3.2.1.10.in-addr.arpa.", false},
+		{"10.1.0.0/20", "", true},
+		{"fd00::/8", "d.f.ip6.arpa.", false},
+		{"fd00:1234::/32", "4.3.2.1.0.0.d.f.ip6.arpa.", false},
+		{"fd00::/6", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.prefix, func(t *testing.T) {
+			_, prefix, err := net.ParseCIDR(tc.prefix)
+			if err != nil {
+				t.Fatalf("error parsing cidr: %v", err)
+			}
+			got, err := reverseZoneName(*prefix)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestReverseNamePrefix(t *testing.T) {
+	testCases := []struct {
+		name string
+		want string // empty if invalid
+	}{
+		{"7.0.0.10.in-addr.arpa.", "10.0.0.7/32"},
+		{"0.10.IN-ADDR.ARPA.", "10.0.0.0/16"},
+		{"in-addr.arpa.", ""},
+		{"1.7.0.0.10.in-addr.arpa.", ""},
+		{"07.0.0.10.in-addr.arpa.", ""},
+		{"256.0.0.10.in-addr.arpa.", ""},
+		{dns.Fqdn("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa"), "fd00::1/128"},
+		{"d.f.ip6.arpa.", "fd00::/8"},
+		{"10.d.f.ip6.arpa.", ""},
+		{"g.d.f.ip6.arpa.", ""},
+		{"example.com.", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix, ok := reverseNamePrefix(tc.name)
+			if !ok {
+				if tc.want != "" {
+					t.Errorf("expected %s, got invalid", tc.want)
+				}
+				return
+			}
+			if prefix.String() != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, prefix)
+			}
+		})
+	}
+}
+
+func TestReverse(t *testing.T) {
+	c := caddy.NewTestController("dns", `wgsd example.com. wg0 {
+		self 192.0.2.1:51820 10.0.0.254/32
+		soa ns1.example.com.
+		reverse 10.0.0.0/24 fd00::/64
+	}`)
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no errors, but got '%v'", err)
+	}
+
+	selfKey := [32]byte{}
+	selfKey[0] = 99
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	peer1.AllowedIPs, _ = constructAllowedIPs(t, []string{"10.0.0.0/24", "fd00::1/128"})
+	key2 := [32]byte{}
+	key2[0] = 2
+	peer2 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("2.2.2.2"),
+			Port: 2,
+		},
+		PublicKey: key2,
+	}
+	peer2.AllowedIPs, _ = constructAllowedIPs(t, []string{"10.0.0.7/32"})
+	peer1Name := instanceName(&Zone{name: "example.com."}, peer1)
+	peer2Name := instanceName(&Zone{name: "example.com."}, peer2)
+	selfName := instanceName(&Zone{name: "example.com."}, wgtypes.Peer{PublicKey: selfKey})
+	p := &WGSD{
+		Next:  test.ErrorHandler(),
+		Zones: zones,
+		client: &mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": {
+					Name:       "wg0",
+					PublicKey:  selfKey,
+					ListenPort: 51820,
+					Peers:      []wgtypes.Peer{peer1, peer2},
+				},
+			},
+		},
+	}
+	reverse4 := p.Z["0.0.10.in-addr.arpa."]
+	reverse6 := p.Z["0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."]
+	peer1Reverse6 := dns.Fqdn("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa")
+
+	testCases := []test.Case{
+		{
+			Qname: "0.0.10.in-addr.arpa.",
+			Qtype: dns.TypeSOA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SOA(soa(reverse4).String()),
+			},
+		},
+		{
+			Qname: "0.0.10.in-addr.arpa.",
+			Qtype: dns.TypeNS,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.NS("0.0.10.in-addr.arpa. 60 IN NS ns1.example.com."),
+			},
+		},
+		{
+			Qname: "1.0.0.10.in-addr.arpa.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("1.0.0.10.in-addr.arpa. 0 IN PTR %s", peer1Name)),
+			},
+		},
+		{
+			// longest prefix match
+			Qname: "7.0.0.10.in-addr.arpa.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("7.0.0.10.in-addr.arpa. 0 IN PTR %s", peer2Name)),
+			},
+		},
+		{
+			Qname: "254.0.0.10.in-addr.arpa.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("254.0.0.10.in-addr.arpa. 0 IN PTR %s", selfName)),
+			},
+		},
+		{
+			Qname: "7.0.0.10.in-addr.arpa.",
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(reverse4).String()),
+			},
+		},
+		{
+			Qname: peer1Reverse6,
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("%s 0 IN PTR %s", peer1Reverse6, peer1Name)),
+			},
+		},
+		{
+			// empty non-terminal above fd00::1
+			Qname: "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(reverse6).String()),
+			},
+		},
+		{
+			Qname: dns.Fqdn("2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa"),
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(reverse6).String()),
+			},
+		},
+		{
+			Qname: "invalid.0.0.10.in-addr.arpa.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(reverse4).String()),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.Qname, dns.TypeToString[tc.Qtype]), func(t *testing.T) {
+			m := tc.Msg()
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := p.ServeDNS(context.TODO(), rec, m)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			resp := rec.Msg
+			if err := test.Header(tc, resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.Section(tc, test.Answer, resp.Answer); err != nil {
+				t.Error(err)
+			}
+			if err := test.Section(tc, test.Ns, resp.Ns); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -1,34 +1,79 @@
 package wgsd
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/transfer"
 	"github.com/miekg/dns"
-	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// maxTTL is the maximum TTL value allowed by RFC2181.
+	maxTTL = 1<<31 - 1
+
+	defaultNotifyInterval  = 5 * time.Second
+	defaultRefreshInterval = time.Second
+	defaultPublishInterval = 5 * time.Second
 )
 
 func init() {
 	plugin.Register(pluginName, setup)
 }
 
-func parse(c *caddy.Controller) (Zones, error) {
+func parse(c *caddy.Controller) (_ Zones, err error) {
 	z := make(map[string]*Zone)
 	names := []string{}
 
+	// Sources may hold connections and goroutines, those constructed are
+	// closed if the configuration is rejected.
+	var sources []PeerSource
+	defer func() {
+		if err != nil {
+			closeSources(sources)
+		}
+	}()
+
 	for c.Next() {
-		// wgsd zone device
+		// wgsd zone device...
 		args := c.RemainingArgs()
-		if len(args) != 2 {
-			return Zones{}, fmt.Errorf("expected 2 args, got %d", len(args))
+		if len(args) < 2 {
+			return Zones{}, fmt.Errorf("expected at least 2 args, got %d", len(args))
 		}
 		zone := &Zone{
-			name:   dns.Fqdn(args[0]),
-			device: args[1],
+			name:    dns.Fqdn(args[0]),
+			devices: args[1:],
+			ttl:     defaultTTLs,
+		}
+		if isGlob(args[1]) {
+			if len(args) > 2 {
+				return Zones{}, fmt.Errorf("device pattern %s must be the only device", args[1])
+			}
+			if !validGlob(args[1]) {
+				return Zones{}, fmt.Errorf("invalid device pattern: %s", args[1])
+			}
+			zone.devices = nil
+			zone.glob = args[1]
+		}
+		for i, device := range zone.devices {
+			if isGlob(device) {
+				return Zones{}, fmt.Errorf("device pattern %s must be the only device", device)
+			}
+			for _, other := range zone.devices[:i] {
+				if device == other {
+					return Zones{}, fmt.Errorf("duplicate device %s", device)
+				}
+			}
 		}
 		names = append(names, zone.name)
 		_, ok := z[zone.name]
@@ -37,20 +82,25 @@ func parse(c *caddy.Controller) (Zones, error) {
 				zone.name)
 		}
 		z[zone.name] = zone
+		var reverse []net.IPNet
 
 		for c.NextBlock() {
 			switch c.Val() {
 			case "self":
-				// self [endpoint] [allowed-ips ... ]
+				// self [endpoint [endpoint]] [allowed-ips ... ]
 				zone.serveSelf = true
 				args = c.RemainingArgs()
 				if len(args) < 1 {
 					break
 				}
 
-				// assume first arg is endpoint
-				host, portS, err := net.SplitHostPort(args[0])
-				if err == nil {
+				// assume leading args in host:port form are endpoints, at
+				// most one per address family
+				for len(args) > 0 {
+					host, portS, err := net.SplitHostPort(args[0])
+					if err != nil {
+						break
+					}
 					port, err := strconv.Atoi(portS)
 					if err != nil {
 						return Zones{}, fmt.Errorf("error converting self endpoint port: %v", err)
@@ -59,10 +109,19 @@ func parse(c *caddy.Controller) (Zones, error) {
 					if ip == nil {
 						return Zones{}, fmt.Errorf("invalid self endpoint IP address: %s", host)
 					}
-					zone.selfEndpoint = &net.UDPAddr{
+					endpoint := &net.UDPAddr{
 						IP:   ip,
 						Port: port,
 					}
+					switch {
+					case zone.selfEndpoint == nil:
+						zone.selfEndpoint = endpoint
+					case zone.selfAltEndpoint == nil &&
+						(ip.To4() == nil) != (zone.selfEndpoint.IP.To4() == nil):
+						zone.selfAltEndpoint = endpoint
+					default:
+						return Zones{}, fmt.Errorf("at most one self endpoint per address family is allowed: %s", args[0])
+					}
 					args = args[1:]
 				}
 
@@ -76,35 +135,427 @@ func parse(c *caddy.Controller) (Zones, error) {
 					}
 					zone.selfAllowedIPs = append(zone.selfAllowedIPs, *prefix)
 				}
+			case "soa":
+				// soa nameserver [mailbox]
+				args = c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Zones{}, c.ArgErr()
+				}
+				for _, arg := range args {
+					if _, ok := dns.IsDomainName(arg); !ok {
+						return Zones{}, fmt.Errorf("invalid soa domain name: %s", arg)
+					}
+				}
+				zone.soaNS = dns.Fqdn(args[0])
+				if len(args) > 1 {
+					zone.soaMbox = dns.Fqdn(args[1])
+				}
+			case "ttl":
+				// ttl [ptr|srv|host|txt|negative] seconds
+				args = c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return Zones{}, c.ArgErr()
+				}
+				ttl, err := strconv.ParseUint(args[len(args)-1], 10, 32)
+				if err != nil || ttl > maxTTL {
+					return Zones{}, fmt.Errorf("invalid ttl value: %s", args[len(args)-1])
+				}
+				if len(args) == 1 {
+					zone.ttl.ptr = uint32(ttl)
+					zone.ttl.srv = uint32(ttl)
+					zone.ttl.host = uint32(ttl)
+					zone.ttl.txt = uint32(ttl)
+					break
+				}
+				switch args[0] {
+				case "ptr":
+					zone.ttl.ptr = uint32(ttl)
+				case "srv":
+					zone.ttl.srv = uint32(ttl)
+				case "host":
+					zone.ttl.host = uint32(ttl)
+				case "txt":
+					zone.ttl.txt = uint32(ttl)
+				case "negative":
+					zone.ttl.negative = uint32(ttl)
+				default:
+					return Zones{}, fmt.Errorf("invalid ttl record kind: %s", args[0])
+				}
+			case "notify":
+				// notify [interval]
+				args = c.RemainingArgs()
+				if len(args) > 1 {
+					return Zones{}, c.ArgErr()
+				}
+				zone.notifyInterval = defaultNotifyInterval
+				if len(args) == 1 {
+					interval, err := time.ParseDuration(args[0])
+					if err != nil || interval <= 0 {
+						return Zones{}, fmt.Errorf("invalid notify interval: %s", args[0])
+					}
+					zone.notifyInterval = interval
+				}
+			case "refresh":
+				// refresh [interval]
+				args = c.RemainingArgs()
+				if len(args) > 1 {
+					return Zones{}, c.ArgErr()
+				}
+				zone.refreshInterval = defaultRefreshInterval
+				if len(args) == 1 {
+					interval, err := time.ParseDuration(args[0])
+					if err != nil || interval <= 0 {
+						return Zones{}, fmt.Errorf("invalid refresh interval: %s", args[0])
+					}
+					zone.refreshInterval = interval
+				}
+			case "publish":
+				// publish [interval]
+				args = c.RemainingArgs()
+				if len(args) > 1 {
+					return Zones{}, c.ArgErr()
+				}
+				zone.publishInterval = defaultPublishInterval
+				if len(args) == 1 {
+					interval, err := time.ParseDuration(args[0])
+					if err != nil || interval <= 0 {
+						return Zones{}, fmt.Errorf("invalid publish interval: %s", args[0])
+					}
+					zone.publishInterval = interval
+				}
+			case "dnssec":
+				// dnssec key...
+				args = c.RemainingArgs()
+				if len(args) < 1 {
+					return Zones{}, c.ArgErr()
+				}
+				for _, base := range args {
+					key, err := readDNSSECKey(base)
+					if err != nil {
+						return Zones{}, fmt.Errorf("error reading dnssec key %s: %v", base, err)
+					}
+					if !strings.EqualFold(key.dnskey.Hdr.Name, zone.name) {
+						return Zones{}, fmt.Errorf("dnssec key %s is for zone %s, not %s",
+							base, key.dnskey.Hdr.Name, zone.name)
+					}
+					zone.keys = append(zone.keys, key)
+				}
+			case "tsig":
+				// tsig key-name secret
+				args = c.RemainingArgs()
+				if len(args) != 2 {
+					return Zones{}, c.ArgErr()
+				}
+				if _, ok := dns.IsDomainName(args[0]); !ok {
+					return Zones{}, fmt.Errorf("invalid tsig key name: %s", args[0])
+				}
+				if _, err := base64.StdEncoding.DecodeString(args[1]); err != nil {
+					return Zones{}, fmt.Errorf("invalid tsig secret for key %s: %v", args[0], err)
+				}
+				zone.tsigKey = dns.CanonicalName(args[0])
+				zone.tsigSecret = args[1]
+			case "tag":
+				// tag tag public-key...
+				args = c.RemainingArgs()
+				if len(args) < 2 {
+					return Zones{}, c.ArgErr()
+				}
+				tag := strings.ToLower(args[0])
+				if !validTag(tag) {
+					return Zones{}, fmt.Errorf("invalid tag: %s", args[0])
+				}
+				if zone.tags == nil {
+					zone.tags = make(map[wgtypes.Key][]string)
+				}
+				for _, pubKey := range args[1:] {
+					key, err := wgtypes.ParseKey(pubKey)
+					if err != nil {
+						return Zones{}, fmt.Errorf("invalid public key '%s' for tag %s: %v", pubKey, tag, err)
+					}
+					if !hasTag(zone, key, tag) {
+						zone.tags[key] = append(zone.tags[key], tag)
+					}
+				}
+			case "metadata":
+				// metadata [handshake|keepalive|transfer|protocol...]
+				metadata, err := parseMetadata(c.RemainingArgs())
+				if err != nil {
+					return Zones{}, err
+				}
+				zone.metadata = metadata
+			case "names":
+				// names file
+				args = c.RemainingArgs()
+				if len(args) != 1 {
+					return Zones{}, c.ArgErr()
+				}
+				names, err := readNames(args[0])
+				if err != nil {
+					return Zones{}, fmt.Errorf("error reading names: %v", err)
+				}
+				zone.names = names
+				zone.nameKeys = indexNames(names)
+			case "encoding":
+				// encoding base32|base32-nopad|base32hex|base32hex-nopad|base64url
+				args = c.RemainingArgs()
+				if len(args) != 1 {
+					return Zones{}, c.ArgErr()
+				}
+				encoding, ok := keyEncodings[strings.ToLower(args[0])]
+				if !ok {
+					return Zones{}, fmt.Errorf("invalid key encoding: %s", args[0])
+				}
+				zone.keyEncoding = encoding
+			case "devicetags":
+				// devicetags
+				if len(c.RemainingArgs()) != 0 {
+					return Zones{}, c.ArgErr()
+				}
+				for _, device := range zone.devices {
+					if !validTag(strings.ToLower(device)) {
+						return Zones{}, fmt.Errorf("device name %s is not a valid tag", device)
+					}
+				}
+				zone.deviceTags = true
+			case "source", "uapi", "conf":
+				// source name [args...]
+				// uapi [dir]
+				// conf file...
+				name := c.Val()
+				args = c.RemainingArgs()
+				if name == "source" {
+					if len(args) < 1 {
+						return Zones{}, c.ArgErr()
+					}
+					name, args = args[0], args[1:]
+				}
+				if zone.client != nil {
+					return Zones{}, fmt.Errorf("only one of source, uapi, and conf may be set")
+				}
+				source, err := newPeerSource(name, zone.name, args)
+				if err != nil {
+					return Zones{}, err
+				}
+				sources = append(sources, source)
+				if client, ok := source.(*confClient); ok {
+					for _, device := range zone.devices {
+						if _, ok := client.paths[device]; !ok {
+							return Zones{}, fmt.Errorf("no configuration file for device %s", device)
+						}
+					}
+				}
+				zone.client = source
+			case "hosts":
+				// hosts
+				if len(c.RemainingArgs()) != 0 {
+					return Zones{}, c.ArgErr()
+				}
+				zone.hosts = true
+			case "reverse":
+				// reverse prefix...
+				args = c.RemainingArgs()
+				if len(args) < 1 {
+					return Zones{}, c.ArgErr()
+				}
+				for _, prefixString := range args {
+					_, prefix, err := net.ParseCIDR(prefixString)
+					if err != nil {
+						return Zones{}, fmt.Errorf("invalid reverse prefix '%s' err: %v", prefixString, err)
+					}
+					if _, err := reverseZoneName(*prefix); err != nil {
+						return Zones{}, fmt.Errorf("invalid reverse prefix '%s' err: %v", prefixString, err)
+					}
+					reverse = append(reverse, *prefix)
+				}
 			default:
 				return Zones{}, c.ArgErr()
 			}
 		}
+
+		if zone.notifyInterval > 0 && zone.soaNS == "" {
+			// secondaries are sent a zone with NS RRs
+			return Zones{}, fmt.Errorf("notify requires the soa option")
+		}
+
+		if _, ok := zone.client.(peerPublisher); zone.publishInterval > 0 && !ok {
+			return Zones{}, fmt.Errorf("publish requires a source that devices can be published to, e.g. etcd")
+		}
+
+		if zone.glob != "" {
+			// sub-zones come and go, so they can't be signed, notified, or
+			// have reverse zones, and there are no local devices to publish
+			switch {
+			case len(zone.keys) > 0:
+				return Zones{}, fmt.Errorf("dnssec is not supported with device pattern %s", zone.glob)
+			case zone.notifyInterval > 0:
+				return Zones{}, fmt.Errorf("notify is not supported with device pattern %s", zone.glob)
+			case len(reverse) > 0:
+				return Zones{}, fmt.Errorf("reverse is not supported with device pattern %s", zone.glob)
+			case zone.publishInterval > 0:
+				return Zones{}, fmt.Errorf("publish is not supported with device pattern %s", zone.glob)
+			}
+		}
+
+		// Reverse zones share the SOA, TTL, and TSIG configuration of their
+		// forward zone, now that the block has been parsed.
+		for _, prefix := range reverse {
+			name, _ := reverseZoneName(prefix)
+			if _, ok := z[name]; ok {
+				return Zones{}, fmt.Errorf("duplicate zone name %s", name)
+			}
+			z[name] = &Zone{
+				name:       name,
+				devices:    zone.devices,
+				soaNS:      zone.soaNS,
+				soaMbox:    zone.soaMbox,
+				ttl:        zone.ttl,
+				tsigKey:    zone.tsigKey,
+				tsigSecret: zone.tsigSecret,
+				forward:    zone,
+			}
+			names = append(names, name)
+		}
 	}
 
 	return Zones{Z: z, Names: names}, nil
 }
 
+// sources returns the sources of the zones with a source of their own.
+func (z Zones) sources() []PeerSource {
+	var sources []PeerSource
+	for _, name := range z.Names {
+		if client := z.Z[name].client; client != nil {
+			sources = append(sources, client)
+		}
+	}
+	return sources
+}
+
+// closeSources closes the sources implementing io.Closer.
+func closeSources(sources []PeerSource) {
+	for _, source := range sources {
+		closer, ok := source.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			logger.Errorf("error closing peer source: %v", err)
+		}
+	}
+}
+
+// validTag returns true if tag may be used as a DNS-SD subtype label. Tags are
+// restricted to lowercase letters, digits, and hyphens so they are usable with
+// all DNS-SD clients, and in the comma-separated tags TXT key.
+func validTag(tag string) bool {
+	// leave room for the leading underscore in the 63 byte label
+	if len(tag) < 1 || len(tag) > 62 {
+		return false
+	}
+	for _, r := range tag {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
 func setup(c *caddy.Controller) error {
 	zones, err := parse(c)
 	if err != nil {
 		return plugin.Error(pluginName, err)
 	}
-	client, err := wgctrl.New()
+	client, err := newWgctrlSource()
 	if err != nil {
-		return plugin.Error(pluginName,
-			fmt.Errorf("error constructing wgctrl client: %v",
-				err))
+		closeSources(zones.sources())
+		return plugin.Error(pluginName, err)
+	}
+
+	// Register the TSIG secrets with the server, which verifies requests and
+	// signs responses.
+	config := dnsserver.GetConfig(c)
+	for _, name := range zones.Names {
+		zone := zones.Z[name]
+		if zone.tsigKey == "" {
+			continue
+		}
+		if config.TsigSecret == nil {
+			config.TsigSecret = make(map[string]string)
+		}
+		config.TsigSecret[zone.tsigKey] = zone.tsigSecret
+	}
+
+	w := &WGSD{
+		Zones:      zones,
+		client:     client,
+		refreshers: newDeviceRefreshers(client, zones),
 	}
-	c.OnFinalShutdown(client.Close)
+
+	// Refresh the device snapshots of zones with refresh enabled, discover the
+	// devices of zones with a device pattern, follow the changes of sources
+	// notifying of them, and watch the devices of zones with notify enabled,
+	// sending notifies via the transfer plugin.
+	ctx, cancel := context.WithCancel(context.Background())
+	c.OnStartup(func() error {
+		// The transfer plugin is only known once the plugin chain is built,
+		// so notify without it can't be rejected when parsing.
+		t := dnsserver.GetConfig(c).Handler("transfer")
+		for _, name := range zones.Names {
+			if zones.Z[name].notifyInterval > 0 && t == nil {
+				return plugin.Error(pluginName,
+					fmt.Errorf("notify for zone %s requires the transfer plugin", name))
+			}
+		}
+		for _, r := range w.refreshers {
+			go r.run(ctx)
+		}
+		for _, name := range zones.Names {
+			zone := zones.Z[name]
+			for _, r := range zone.refreshers {
+				go r.run(ctx)
+			}
+			if n, ok := zone.client.(PeerSourceNotifier); ok {
+				go zone.watchChanges(ctx, n.Changes())
+			}
+			if zone.publishInterval > 0 {
+				go zone.runPublish(ctx, client, zone.publishInterval)
+			}
+			if zone.glob == "" {
+				continue
+			}
+			interval := zone.refreshInterval
+			if interval == 0 {
+				interval = defaultDiscoverInterval
+			}
+			go zone.runDiscovery(ctx, zoneClient(client, zone), interval)
+		}
+		for _, name := range zones.Names {
+			zone := zones.Z[name]
+			if zone.notifyInterval == 0 {
+				continue
+			}
+			watcher := &zoneWatcher{
+				client:     client,
+				refreshers: w.refreshers,
+				zone:       zone,
+				notifier:   t.(*transfer.Transfer), // if found this must be OK.
+			}
+			go watcher.run(ctx, zone.notifyInterval)
+		}
+		return nil
+	})
+	// Sources are constructed again on reload, so they are closed on every
+	// shutdown rather than only the final one.
+	c.OnShutdown(func() error {
+		cancel()
+		closeSources(zones.sources())
+		return client.Close()
+	})
 
 	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return &WGSD{
-			Next:   next,
-			Zones:  zones,
-			client: client,
-		}
+		w.Next = next
+		return w
 	})
 	return nil
 }
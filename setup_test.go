@@ -4,8 +4,10 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestSetup(t *testing.T) {
@@ -14,6 +16,23 @@ func TestSetup(t *testing.T) {
 	_, prefix3, _ := net.ParseCIDR("3.3.3.3/32")
 	_, prefix4, _ := net.ParseCIDR("4.4.4.4/32")
 	endpoint1 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51820}
+	endpoint2 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 51820}
+	key1, _ := wgtypes.ParseKey("xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=")
+	key2, _ := wgtypes.ParseKey("syKB97XhGnvC+kynh2KqQJPXoOoOpx/HmpMRTc+r4js=")
+
+	reverseForward := &Zone{
+		name:    "example.com.",
+		devices: []string{"wg0"},
+		ttl:     defaultTTLs,
+	}
+	reverseZone := func(name string) *Zone {
+		return &Zone{
+			name:    name,
+			devices: []string{"wg0"},
+			ttl:     defaultTTLs,
+			forward: reverseForward,
+		}
+	}
 
 	testCases := []struct {
 		name          string
@@ -28,8 +47,9 @@ func TestSetup(t *testing.T) {
 			Zones{
 				Z: map[string]*Zone{
 					"example.com.": {
-						name:   "example.com.",
-						device: "wg0",
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl:     defaultTTLs,
 					},
 				},
 				Names: []string{"example.com."},
@@ -42,8 +62,162 @@ func TestSetup(t *testing.T) {
 			Zones{},
 		},
 		{
-			"too many tokens",
-			"wgsd example.com. wg0 extra",
+			"multiple devices",
+			"wgsd example.com. wg0 wg1",
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0", "wg1"},
+						ttl:     defaultTTLs,
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"duplicate device",
+			"wgsd example.com. wg0 wg1 wg0",
+			true,
+			Zones{},
+		},
+		{
+			"device pattern",
+			"wgsd example.com. wg-site-*",
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name: "example.com.",
+						glob: "wg-site-*",
+						ttl:  defaultTTLs,
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"device pattern with other devices",
+			"wgsd example.com. wg0 wg-site-*",
+			true,
+			Zones{},
+		},
+		{
+			"invalid device pattern",
+			"wgsd example.com. wg[",
+			true,
+			Zones{},
+		},
+		{
+			"device pattern with notify",
+			`wgsd example.com. wg* {
+						notify
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"uapi",
+			`wgsd example.com. wg0 {
+						uapi
+					}
+					wgsd example2.com. wg1 {
+						uapi /run/wg
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl:     defaultTTLs,
+						client:  &uapiClient{dir: defaultUAPIDir},
+					},
+					"example2.com.": {
+						name:    "example2.com.",
+						devices: []string{"wg1"},
+						ttl:     defaultTTLs,
+						client:  &uapiClient{dir: "/run/wg"},
+					},
+				},
+				Names: []string{"example.com.", "example2.com."},
+			},
+		},
+		{
+			"uapi with too many args",
+			`wgsd example.com. wg0 {
+						uapi /run/wg /var/run/wireguard
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"source",
+			`wgsd example.com. wg0 {
+						source uapi /run/wg
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl:     defaultTTLs,
+						client:  &uapiClient{dir: "/run/wg"},
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"source without name",
+			`wgsd example.com. wg0 {
+						source
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"unknown source",
+			`wgsd example.com. wg0 {
+						source unknown
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"multiple sources",
+			`wgsd example.com. wg0 {
+						source uapi
+						uapi /run/wg
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"devicetags",
+			`wgsd example.com. wg0 WG1 {
+						devicetags
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:       "example.com.",
+						devices:    []string{"wg0", "WG1"},
+						ttl:        defaultTTLs,
+						deviceTags: true,
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"devicetags with invalid device name",
+			`wgsd example.com. wg0 wg_1 {
+						devicetags
+					}`,
 			true,
 			Zones{},
 		},
@@ -57,7 +231,8 @@ func TestSetup(t *testing.T) {
 				Z: map[string]*Zone{
 					"example.com.": {
 						name:           "example.com.",
-						device:         "wg0",
+						devices:        []string{"wg0"},
+						ttl:            defaultTTLs,
 						serveSelf:      true,
 						selfAllowedIPs: []net.IPNet{*prefix1, *prefix2},
 					},
@@ -83,7 +258,8 @@ func TestSetup(t *testing.T) {
 				Z: map[string]*Zone{
 					"example.com.": {
 						name:         "example.com.",
-						device:       "wg0",
+						devices:      []string{"wg0"},
+						ttl:          defaultTTLs,
 						serveSelf:    true,
 						selfEndpoint: endpoint1,
 					},
@@ -91,6 +267,35 @@ func TestSetup(t *testing.T) {
 				Names: []string{"example.com."},
 			},
 		},
+		{
+			"valid dual-stack self-endpoints",
+			`wgsd example.com. wg0 {
+						self 127.0.0.1:51820 [::1]:51820 1.1.1.1/32
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:            "example.com.",
+						devices:         []string{"wg0"},
+						ttl:             defaultTTLs,
+						serveSelf:       true,
+						selfEndpoint:    endpoint1,
+						selfAltEndpoint: endpoint2,
+						selfAllowedIPs:  []net.IPNet{*prefix1},
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"duplicate address family self-endpoints",
+			`wgsd example.com. wg0 {
+						self 127.0.0.1:51820 127.0.0.2:51820
+					}`,
+			true,
+			Zones{},
+		},
 		{
 			"invalid self-endpoint",
 			`wgsd example.com. wg0 {
@@ -99,6 +304,356 @@ func TestSetup(t *testing.T) {
 			true,
 			Zones{},
 		},
+		{
+			"valid soa",
+			`wgsd example.com. wg0 {
+						soa ns.example.net hostmaster.example.net.
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl:     defaultTTLs,
+						soaNS:   "ns.example.net.",
+						soaMbox: "hostmaster.example.net.",
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"invalid soa",
+			`wgsd example.com. wg0 {
+						soa
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"valid ttl",
+			`wgsd example.com. wg0 {
+						ttl 30
+						ttl srv 10
+						ttl negative 5
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl: ttls{
+							ptr:      30,
+							srv:      10,
+							host:     30,
+							txt:      30,
+							negative: 5,
+						},
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"invalid ttl kind",
+			`wgsd example.com. wg0 {
+						ttl mx 30
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"invalid ttl value",
+			`wgsd example.com. wg0 {
+						ttl -1
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"valid notify",
+			`wgsd example.com. wg0 {
+						soa ns1.example.com.
+						notify
+					}
+					wgsd example2.com. wg1 {
+						soa ns1.example2.com.
+						notify 1m
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:           "example.com.",
+						devices:        []string{"wg0"},
+						ttl:            defaultTTLs,
+						soaNS:          "ns1.example.com.",
+						notifyInterval: defaultNotifyInterval,
+					},
+					"example2.com.": {
+						name:           "example2.com.",
+						devices:        []string{"wg1"},
+						ttl:            defaultTTLs,
+						soaNS:          "ns1.example2.com.",
+						notifyInterval: time.Minute,
+					},
+				},
+				Names: []string{"example.com.", "example2.com."},
+			},
+		},
+		{
+			"notify without soa",
+			`wgsd example.com. wg0 {
+						notify
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"invalid notify",
+			`wgsd example.com. wg0 {
+						notify -1s
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"valid refresh",
+			`wgsd example.com. wg0 {
+						refresh
+					}
+					wgsd example2.com. wg1 {
+						refresh 100ms
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:            "example.com.",
+						devices:         []string{"wg0"},
+						ttl:             defaultTTLs,
+						refreshInterval: defaultRefreshInterval,
+					},
+					"example2.com.": {
+						name:            "example2.com.",
+						devices:         []string{"wg1"},
+						ttl:             defaultTTLs,
+						refreshInterval: 100 * time.Millisecond,
+					},
+				},
+				Names: []string{"example.com.", "example2.com."},
+			},
+		},
+		{
+			"invalid refresh",
+			`wgsd example.com. wg0 {
+						refresh 0s
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"valid tsig",
+			`wgsd example.com. wg0 {
+						tsig Key.Example.com c2VjcmV0
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:       "example.com.",
+						devices:    []string{"wg0"},
+						ttl:        defaultTTLs,
+						tsigKey:    "key.example.com.",
+						tsigSecret: "c2VjcmV0",
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"invalid tsig secret",
+			`wgsd example.com. wg0 {
+						tsig key.example.com. not-base64!
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"missing tsig secret",
+			`wgsd example.com. wg0 {
+						tsig key.example.com.
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"valid tag",
+			`wgsd example.com. wg0 {
+						tag Gateway xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=
+						tag laptop xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4= syKB97XhGnvC+kynh2KqQJPXoOoOpx/HmpMRTc+r4js=
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl:     defaultTTLs,
+						tags: map[wgtypes.Key][]string{
+							key1: {"gateway", "laptop"},
+							key2: {"laptop"},
+						},
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"invalid tag",
+			`wgsd example.com. wg0 {
+						tag build_runner xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6+yffAHw4=
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"invalid tag public key",
+			`wgsd example.com. wg0 {
+						tag gateway xScVkH3fUGUv4RrJFfmcqm8rs3SEHr41km6
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"metadata",
+			`wgsd example.com. wg0 {
+						metadata
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:     "example.com.",
+						devices:  []string{"wg0"},
+						ttl:      defaultTTLs,
+						metadata: metadataAll,
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"metadata kinds",
+			`wgsd example.com. wg0 {
+						metadata handshake transfer
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:     "example.com.",
+						devices:  []string{"wg0"},
+						ttl:      defaultTTLs,
+						metadata: metadataHandshake | metadataTransfer,
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"invalid metadata kind",
+			`wgsd example.com. wg0 {
+						metadata endpoint
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"valid reverse",
+			`wgsd example.com. wg0 {
+						reverse 10.0.0.0/24 fd00::/64
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.":         reverseForward,
+					"0.0.10.in-addr.arpa.": reverseZone("0.0.10.in-addr.arpa."),
+					"0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": reverseZone("0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."),
+				},
+				Names: []string{"example.com.", "0.0.10.in-addr.arpa.", "0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."},
+			},
+		},
+		{
+			"unaligned reverse prefix",
+			`wgsd example.com. wg0 {
+						reverse 10.0.0.0/20
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"invalid reverse prefix",
+			`wgsd example.com. wg0 {
+						reverse 10.0.0.0
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"hosts",
+			`wgsd example.com. wg0 {
+						hosts
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl:     defaultTTLs,
+						hosts:   true,
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"hosts with args",
+			`wgsd example.com. wg0 {
+						hosts mesh
+					}`,
+			true,
+			Zones{},
+		},
+		{
+			"encoding",
+			`wgsd example.com. wg0 {
+						encoding base32hex-nopad
+					}`,
+			false,
+			Zones{
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:        "example.com.",
+						devices:     []string{"wg0"},
+						ttl:         defaultTTLs,
+						keyEncoding: encodingBase32HexNoPad,
+					},
+				},
+				Names: []string{"example.com."},
+			},
+		},
+		{
+			"invalid encoding",
+			`wgsd example.com. wg0 {
+						encoding hex
+					}`,
+			true,
+			Zones{},
+		},
 		{
 			"multiple blocks",
 			`wgsd example.com. wg0 {
@@ -112,14 +667,16 @@ func TestSetup(t *testing.T) {
 				Z: map[string]*Zone{
 					"example.com.": {
 						name:           "example.com.",
-						device:         "wg0",
+						devices:        []string{"wg0"},
+						ttl:            defaultTTLs,
 						serveSelf:      true,
 						selfEndpoint:   endpoint1,
 						selfAllowedIPs: []net.IPNet{*prefix1, *prefix2},
 					},
 					"example2.com.": {
 						name:           "example2.com.",
-						device:         "wg1",
+						devices:        []string{"wg1"},
+						ttl:            defaultTTLs,
 						serveSelf:      true,
 						selfEndpoint:   endpoint1,
 						selfAllowedIPs: []net.IPNet{*prefix3, *prefix4},
@@ -132,16 +689,20 @@ func TestSetup(t *testing.T) {
 			"all options",
 			`wgsd example.com. wg0 {
 						self 127.0.0.1:51820 1.1.1.1/32 2.2.2.2/32
+						soa ns.example.net hostmaster.example.net.
 					}`,
 			false,
 			Zones{
 				Z: map[string]*Zone{
 					"example.com.": {
 						name:           "example.com.",
-						device:         "wg0",
+						devices:        []string{"wg0"},
+						ttl:            defaultTTLs,
 						serveSelf:      true,
 						selfEndpoint:   endpoint1,
 						selfAllowedIPs: []net.IPNet{*prefix1, *prefix2},
+						soaNS:          "ns.example.net.",
+						soaMbox:        "hostmaster.example.net.",
 					},
 				},
 				Names: []string{"example.com."},
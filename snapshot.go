@@ -0,0 +1,169 @@
+package wgsd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"sort"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// deviceSnapshot is a WireGuard device as retrieved at one point in time, or
+// the merge of several. It is shared by concurrent queries and must not be
+// modified.
+type deviceSnapshot struct {
+	device      *wgtypes.Device
+	fingerprint [sha256.Size]byte      // fingerprintDevice(device), and origins if merged
+	index       map[wgtypes.Key]int    // indices of device.Peers by public key
+	origins     map[wgtypes.Key]string // device names of peers if merged, nil otherwise
+}
+
+func newDeviceSnapshot(device *wgtypes.Device) *deviceSnapshot {
+	return &deviceSnapshot{
+		device:      device,
+		fingerprint: fingerprintDevice(device),
+		index:       indexPeers(device.Peers),
+	}
+}
+
+// mergeSnapshots returns a snapshot of the peers of all snapshots. The local
+// device is that of the first snapshot. Peers configured on more than one
+// device are served from the device they most recently completed a handshake
+// over, or the first of them if none.
+func mergeSnapshots(snapshots []*deviceSnapshot) *deviceSnapshot {
+	first := snapshots[0].device
+	device := &wgtypes.Device{
+		Name:       first.Name,
+		Type:       first.Type,
+		PublicKey:  first.PublicKey,
+		ListenPort: first.ListenPort,
+	}
+	index := make(map[wgtypes.Key]int)
+	origins := make(map[wgtypes.Key]string)
+	for _, s := range snapshots {
+		for _, peer := range s.device.Peers {
+			i, ok := index[peer.PublicKey]
+			if !ok {
+				index[peer.PublicKey] = len(device.Peers)
+				device.Peers = append(device.Peers, peer)
+				origins[peer.PublicKey] = s.device.Name
+				continue
+			}
+			if peer.LastHandshakeTime.After(device.Peers[i].LastHandshakeTime) {
+				device.Peers[i] = peer
+				origins[peer.PublicKey] = s.device.Name
+			}
+		}
+	}
+
+	// The origins of peers are reflected in their tags, so they are part of
+	// the fingerprint.
+	keys := make([]wgtypes.Key, 0, len(origins))
+	for key := range origins {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	fingerprint := fingerprintDevice(device)
+	h := sha256.New()
+	h.Write(fingerprint[:])
+	for _, key := range keys {
+		h.Write(key[:])
+		h.Write([]byte(origins[key]))
+		h.Write([]byte{0})
+	}
+	merged := &deviceSnapshot{
+		device:  device,
+		index:   index,
+		origins: origins,
+	}
+	copy(merged.fingerprint[:], h.Sum(nil))
+	return merged
+}
+
+// mergedSnapshot holds the merged snapshot of the devices of a zone, so that
+// unchanged device snapshots are only merged once.
+type mergedSnapshot struct {
+	mu        sync.Mutex
+	snapshots []*deviceSnapshot // the device snapshots merged
+	merged    *deviceSnapshot
+}
+
+// get returns the merge of snapshots.
+func (m *mergedSnapshot) get(snapshots []*deviceSnapshot) *deviceSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.merged != nil && len(m.snapshots) == len(snapshots) {
+		unchanged := true
+		for i := range snapshots {
+			if snapshots[i] != m.snapshots[i] {
+				unchanged = false
+				break
+			}
+		}
+		if unchanged {
+			return m.merged
+		}
+	}
+	m.snapshots = snapshots
+	m.merged = mergeSnapshots(snapshots)
+	return m.merged
+}
+
+// zoneSnapshot returns a snapshot of the WireGuard devices of zone. Devices
+// without a refresher are retrieved on every call, updating the endpoint cache
+// of zone. Reverse zones use the devices of their forward zone, sub-zones their
+// own refresher if any, and zones with a source of their own their own
+// refreshers.
+func zoneSnapshot(ctx context.Context, client PeerSource,
+	refreshers deviceRefreshers, zone *Zone) (*deviceSnapshot, error) {
+	if zone.forward != nil {
+		zone = zone.forward
+	}
+	if zone.refresher != nil {
+		return zone.refresher.get(ctx)
+	}
+	if zone.client != nil {
+		refreshers = zone.refreshers
+	}
+	client = zoneClient(client, zone)
+	snapshots := make([]*deviceSnapshot, 0, len(zone.devices))
+	for _, name := range zone.devices {
+		if r, ok := refreshers[name]; ok {
+			snapshot, err := r.get(ctx)
+			if err != nil {
+				return nil, err
+			}
+			snapshots = append(snapshots, snapshot)
+			continue
+		}
+		device, err := client.Device(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := newDeviceSnapshot(device)
+		zone.endpoints.update(snapshot)
+		snapshots = append(snapshots, snapshot)
+	}
+	if len(snapshots) == 1 {
+		return snapshots[0], nil
+	}
+	return zone.merged.get(snapshots), nil
+}
+
+// zoneClient returns the source retrieving the devices of zone: the source of
+// zone if set, client otherwise.
+func zoneClient(client PeerSource, zone *Zone) PeerSource {
+	if zone.client != nil {
+		return zone.client
+	}
+	return client
+}
+
+// snapshot returns a snapshot of the WireGuard devices of zone.
+func (p *WGSD) snapshot(ctx context.Context, zone *Zone) (*deviceSnapshot, error) {
+	return zoneSnapshot(ctx, p.client, p.refreshers, zone)
+}
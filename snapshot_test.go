@@ -0,0 +1,204 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMultipleDevices(t *testing.T) {
+	handshake := time.Unix(1700000000, 0)
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1wg0 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey:         key1,
+		LastHandshakeTime: handshake,
+	}
+	peer1wg1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.2"),
+			Port: 1,
+		},
+		PublicKey:         key1,
+		LastHandshakeTime: handshake.Add(time.Minute),
+	}
+	key2 := [32]byte{}
+	key2[0] = 2
+	peer2 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("2.2.2.2"),
+			Port: 2,
+		},
+		PublicKey: key2,
+	}
+	key3 := [32]byte{}
+	key3[0] = 3
+	peer3 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("3.3.3.3"),
+			Port: 3,
+		},
+		PublicKey: key3,
+	}
+	selfKey := [32]byte{}
+	selfKey[0] = 99
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg0": {
+				Name:       "wg0",
+				PublicKey:  selfKey,
+				ListenPort: 51820,
+				Peers:      []wgtypes.Peer{peer1wg0, peer3},
+			},
+			"wg1": {
+				Name:       "wg1",
+				ListenPort: 51821,
+				Peers:      []wgtypes.Peer{peer1wg1, peer2},
+			},
+		},
+	}
+	zones := Zones{
+		Names: []string{"example.com."},
+		Z: map[string]*Zone{
+			"example.com.": {
+				name:            "example.com.",
+				devices:         []string{"wg0", "wg1"},
+				ttl:             defaultTTLs,
+				serveSelf:       true,
+				deviceTags:      true,
+				refreshInterval: time.Minute,
+			},
+		},
+	}
+	p := &WGSD{
+		Next:       test.ErrorHandler(),
+		Zones:      zones,
+		client:     client,
+		refreshers: newDeviceRefreshers(client, zones),
+	}
+	zone := zones.Z["example.com."]
+	peer1Name := instanceName(zone, peer1wg1)
+	peer2Name := instanceName(zone, peer2)
+	peer3Name := instanceName(zone, peer3)
+	selfName := instanceName(zone, wgtypes.Peer{PublicKey: selfKey})
+
+	testCases := []test.Case{
+		{
+			Qname: "_wireguard._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s", peer1Name)),
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s", peer3Name)),
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s", peer2Name)),
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.com. 0 IN PTR %s", selfName)),
+			},
+		},
+		{
+			// the most recent handshake wins
+			Qname: peer1Name,
+			Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SRV(fmt.Sprintf("%s 0 IN SRV 0 0 1 %s", peer1Name, peer1Name)),
+			},
+			Extra: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 1.1.1.2", peer1Name)),
+				test.TXT(fmt.Sprintf(`%s 0 IN TXT "txtvers=%d" "pub=%s" "allowed=" "tags=wg1"`,
+					peer1Name, txtVersion, "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")),
+			},
+		},
+		{
+			Qname: "_wg1._sub._wireguard._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_wg1._sub._wireguard._udp.example.com. 0 IN PTR %s", peer1Name)),
+				test.PTR(fmt.Sprintf("_wg1._sub._wireguard._udp.example.com. 0 IN PTR %s", peer2Name)),
+			},
+		},
+		{
+			// self is the first device
+			Qname: "_wg0._sub._wireguard._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_wg0._sub._wireguard._udp.example.com. 0 IN PTR %s", peer3Name)),
+				test.PTR(fmt.Sprintf("_wg0._sub._wireguard._udp.example.com. 0 IN PTR %s", selfName)),
+			},
+		},
+		{
+			Qname: selfName,
+			Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SRV(fmt.Sprintf("%s 0 IN SRV 0 0 51820 %s", selfName, selfName)),
+			},
+			Extra: []dns.RR{
+				test.A(fmt.Sprintf("%s 0 IN A 127.0.0.1", selfName)),
+				test.TXT(fmt.Sprintf(`%s 0 IN TXT "txtvers=%d" "pub=%s" "allowed=" "tags=wg0"`,
+					selfName, txtVersion, "YwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.Qname, dns.TypeToString[tc.Qtype]), func(t *testing.T) {
+			m := tc.Msg()
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := p.ServeDNS(context.TODO(), rec, m)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			resp := rec.Msg
+			if err := test.Header(tc, resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.Section(tc, test.Answer, resp.Answer); err != nil {
+				t.Error(err)
+			}
+			if err := test.Section(tc, test.Extra, resp.Extra); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// unchanged device snapshots are merged once
+	first, err := p.snapshot(context.Background(), zone)
+	if err != nil {
+		t.Fatalf("error retrieving snapshot: %v", err)
+	}
+	second, _ := p.snapshot(context.Background(), zone)
+	if first != second {
+		t.Error("expected unchanged snapshots to be merged once")
+	}
+
+	// the merged fingerprint reflects the device a peer is served from
+	peer1wg0.LastHandshakeTime = handshake.Add(time.Hour)
+	client.devices["wg0"] = &wgtypes.Device{
+		Name:       "wg0",
+		PublicKey:  selfKey,
+		ListenPort: 51820,
+		Peers:      []wgtypes.Peer{peer1wg0, peer3},
+	}
+	if err := p.refreshers["wg0"].refresh(context.Background()); err != nil {
+		t.Fatalf("error refreshing: %v", err)
+	}
+	third, _ := p.snapshot(context.Background(), zone)
+	if third.fingerprint == first.fingerprint {
+		t.Error("expected fingerprint to change")
+	}
+	if origin := (&peerSet{snapshot: third}).origin(key1); origin != "wg0" {
+		t.Errorf("expected peer1 from wg0, got %s", origin)
+	}
+}
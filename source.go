@@ -0,0 +1,202 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PeerSource provides the WireGuard devices, and their peers, served by wgsd.
+// Sources are selected per zone with the source option. Implementations must
+// be safe for concurrent use. Devices returned must not be modified
+// afterwards, as they are shared by concurrent queries. Sources are
+// constructed for every server instance, and those implementing io.Closer are
+// closed when the instance shuts down, including on reload.
+type PeerSource interface {
+	// Device returns the device named name.
+	Device(ctx context.Context, name string) (*wgtypes.Device, error)
+
+	// Devices returns all devices, used to discover the devices matching a
+	// device pattern.
+	Devices(ctx context.Context) ([]*wgtypes.Device, error)
+}
+
+// PeerSourceNotifier is implemented by PeerSources that notify wgsd of changes
+// to their devices. Changed devices of zones with refresh enabled are
+// refreshed immediately, instead of at the next refresh interval.
+type PeerSourceNotifier interface {
+	PeerSource
+
+	// Changes returns a channel receiving the name of a device whenever it
+	// changes. It is called once, after the source is constructed.
+	Changes() <-chan string
+}
+
+// PeerSourceFactory constructs the PeerSource of zone from the arguments of
+// the source option following the source name.
+type PeerSourceFactory func(zone string, args []string) (PeerSource, error)
+
+var (
+	peerSourcesMu sync.RWMutex
+	peerSources   = make(map[string]PeerSourceFactory)
+)
+
+// RegisterPeerSource registers factory as the PeerSourceFactory of the source
+// named name. It is meant to be called from the init function of the package
+// implementing the source, and panics if name is already registered.
+func RegisterPeerSource(name string, factory PeerSourceFactory) {
+	peerSourcesMu.Lock()
+	defer peerSourcesMu.Unlock()
+	if _, ok := peerSources[name]; ok {
+		panic(fmt.Sprintf("wgsd: peer source %s already registered", name))
+	}
+	peerSources[name] = factory
+}
+
+// PeerSources returns the names of the registered peer sources.
+func PeerSources() []string {
+	peerSourcesMu.RLock()
+	defer peerSourcesMu.RUnlock()
+	names := make([]string, 0, len(peerSources))
+	for name := range peerSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newPeerSource constructs the source named name for zone.
+func newPeerSource(name, zone string, args []string) (PeerSource, error) {
+	peerSourcesMu.RLock()
+	factory, ok := peerSources[name]
+	peerSourcesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown peer source: %s", name)
+	}
+	return factory(zone, args)
+}
+
+// wgctrlSource is the default PeerSource, retrieving devices via wgctrl from
+// the kernel, or the UAPI sockets of userspace implementations in
+// /var/run/wireguard.
+type wgctrlSource struct {
+	client *wgctrl.Client
+}
+
+func newWgctrlSource() (*wgctrlSource, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("error constructing wgctrl client: %v", err)
+	}
+	return &wgctrlSource{client: client}, nil
+}
+
+func (w *wgctrlSource) Device(_ context.Context, name string) (*wgtypes.Device, error) {
+	return w.client.Device(name)
+}
+
+func (w *wgctrlSource) Devices(_ context.Context) ([]*wgtypes.Device, error) {
+	return w.client.Devices()
+}
+
+func (w *wgctrlSource) Close() error {
+	return w.client.Close()
+}
+
+func init() {
+	RegisterPeerSource("wgctrl", func(_ string, args []string) (PeerSource, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("wgctrl source takes no arguments")
+		}
+		return newWgctrlSource()
+	})
+	RegisterPeerSource("uapi", func(_ string, args []string) (PeerSource, error) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("uapi source takes at most one directory")
+		}
+		dir := defaultUAPIDir
+		if len(args) == 1 {
+			dir = args[0]
+		}
+		return &uapiClient{dir: dir}, nil
+	})
+	RegisterPeerSource("conf", func(_ string, args []string) (PeerSource, error) {
+		if len(args) < 1 {
+			return nil, fmt.Errorf("conf source requires at least one file")
+		}
+		client, err := newConfClient(args)
+		if err != nil {
+			return nil, fmt.Errorf("error reading wg-quick configuration: %v", err)
+		}
+		return client, nil
+	})
+}
+
+// watchChanges refreshes the changed devices of zone received from changes,
+// a channel of its source, until ctx is canceled or changes is closed. Zones
+// with a device pattern discover their devices again instead.
+func (z *Zone) watchChanges(ctx context.Context, changes <-chan string) {
+	for {
+		var device string
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok := <-changes:
+			if !ok {
+				return
+			}
+			device = d
+		}
+		if z.glob != "" {
+			if err := z.discover(ctx, z.client); err != nil {
+				logger.Errorf("error discovering devices for zone %s: %v",
+					z.name, err)
+			}
+			continue
+		}
+		r, ok := z.refreshers[device]
+		if !ok {
+			continue
+		}
+		if err := r.refresh(ctx); err != nil {
+			logger.Errorf("error refreshing device %s: %v", device, err)
+		}
+	}
+}
+
+// peerPublisher is implemented by PeerSources that the local devices of a zone
+// can be published to, see the publish option.
+type peerPublisher interface {
+	publish(ctx context.Context, device *wgtypes.Device) error
+}
+
+// runPublish publishes the devices of zone, retrieved from local, to the
+// source of zone every interval until ctx is canceled.
+func (z *Zone) runPublish(ctx context.Context, local PeerSource,
+	interval time.Duration) {
+	publisher := z.client.(peerPublisher)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, name := range z.devices {
+			device, err := local.Device(ctx, name)
+			if err == nil {
+				err = publisher.publish(ctx, device)
+			}
+			if err != nil {
+				logger.Errorf("error publishing device %s for zone %s: %v",
+					name, z.name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
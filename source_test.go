@@ -0,0 +1,214 @@
+package wgsd
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// notifyingSource is a PeerSourceNotifier whose devices are set by tests.
+type notifyingSource struct {
+	mu      sync.Mutex
+	devices map[string]*wgtypes.Device
+	changes chan string
+}
+
+func (n *notifyingSource) Device(_ context.Context, name string) (*wgtypes.Device, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.devices[name], nil
+}
+
+func (n *notifyingSource) Devices(_ context.Context) ([]*wgtypes.Device, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	devices := make([]*wgtypes.Device, 0, len(n.devices))
+	for _, device := range n.devices {
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+func (n *notifyingSource) Changes() <-chan string {
+	return n.changes
+}
+
+// set replaces the device and notifies of the change.
+func (n *notifyingSource) set(device *wgtypes.Device) {
+	n.mu.Lock()
+	n.devices[device.Name] = device
+	n.mu.Unlock()
+	n.changes <- device.Name
+}
+
+func TestRegisterPeerSource(t *testing.T) {
+	// the registry is global, register under a new name for every run
+	name := "test" + strconv.Itoa(len(PeerSources()))
+	source := &mockClient{}
+	var gotZone string
+	var gotArgs []string
+	RegisterPeerSource(name, func(zone string, args []string) (PeerSource, error) {
+		gotZone, gotArgs = zone, args
+		return source, nil
+	})
+
+	found := false
+	for _, registered := range PeerSources() {
+		found = found || registered == name
+	}
+	if !found {
+		t.Errorf("expected %s in registered sources, got %v", name, PeerSources())
+	}
+
+	c := caddy.NewTestController("dns", `wgsd example.com. wg0 {
+		source `+name+` a b
+	}`)
+	zones, err := parse(c)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if zones.Z["example.com."].client != source {
+		t.Errorf("expected zone to be served from registered source")
+	}
+	if gotZone != "example.com." || !reflect.DeepEqual(gotArgs, []string{"a", "b"}) {
+		t.Errorf("expected zone example.com. and args [a b], got %s %v", gotZone, gotArgs)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering duplicate source")
+		}
+	}()
+	RegisterPeerSource(name, nil)
+}
+
+// closingSource is a PeerSource recording whether it was closed.
+type closingSource struct {
+	mockClient
+	closed bool
+}
+
+func (c *closingSource) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPeerSourceClosedOnError(t *testing.T) {
+	name := "test" + strconv.Itoa(len(PeerSources()))
+	var sources []*closingSource
+	RegisterPeerSource(name, func(string, []string) (PeerSource, error) {
+		source := &closingSource{}
+		sources = append(sources, source)
+		return source, nil
+	})
+
+	for _, input := range []string{
+		`wgsd example.com. wg0 {
+			source ` + name + `
+			ttl invalid 1
+		}`,
+		`wgsd example.com. wg0 {
+			source ` + name + `
+			publish
+		}`,
+		`wgsd example.com. wg0 {
+			source ` + name + `
+		}
+		wgsd example.com. wg1`,
+	} {
+		sources = nil
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Fatalf("expected error for %s", input)
+		}
+		if len(sources) != 1 || !sources[0].closed {
+			t.Errorf("expected source to be closed for %s", input)
+		}
+	}
+}
+
+func TestPeerSourceChanges(t *testing.T) {
+	key1 := wgtypes.Key{1}
+	key2 := wgtypes.Key{2}
+	source := &notifyingSource{
+		devices: map[string]*wgtypes.Device{
+			"wg0": {
+				Name:  "wg0",
+				Peers: []wgtypes.Peer{{PublicKey: key1}},
+			},
+		},
+		changes: make(chan string),
+	}
+	globSource := &notifyingSource{
+		devices: make(map[string]*wgtypes.Device),
+		changes: make(chan string),
+	}
+	zones := Zones{
+		Names: []string{"example.com.", "devices.example.com."},
+		Z: map[string]*Zone{
+			"example.com.": {
+				name:            "example.com.",
+				devices:         []string{"wg0"},
+				ttl:             defaultTTLs,
+				refreshInterval: time.Hour,
+				client:          source,
+			},
+			"devices.example.com.": {
+				name:            "devices.example.com.",
+				glob:            "wg*",
+				ttl:             defaultTTLs,
+				refreshInterval: time.Hour,
+				client:          globSource,
+			},
+		},
+	}
+	p := &WGSD{
+		Zones:      zones,
+		client:     &mockClient{},
+		refreshers: newDeviceRefreshers(&mockClient{}, zones),
+	}
+	if len(p.refreshers) != 0 {
+		t.Errorf("expected no shared refreshers, got %v", p.refreshers)
+	}
+	zone := zones.Z["example.com."]
+	if zone.refreshers["wg0"] == nil {
+		t.Fatalf("expected zone refresher for wg0, got %v", zone.refreshers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go zone.watchChanges(ctx, source.Changes())
+	glob := zones.Z["devices.example.com."]
+	go glob.watchChanges(ctx, globSource.Changes())
+
+	snapshot, err := p.snapshot(ctx, zone)
+	if err != nil || len(snapshot.device.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %v, %v", snapshot, err)
+	}
+
+	changed := &wgtypes.Device{
+		Name:  "wg0",
+		Peers: []wgtypes.Peer{{PublicKey: key1}, {PublicKey: key2}},
+	}
+	source.set(changed)
+	globSource.set(&wgtypes.Device{Name: "wg1"})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		snapshot, _ = p.snapshot(ctx, zone)
+		sub, _ := glob.subZone("wg1.")
+		if snapshot.device == changed && sub != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for changes to be applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,85 @@
+package wgsd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// subPrefix is the parent of the DNS-SD subtype names of the _wireguard._udp
+// service, see RFC6763 section 7.1.
+const subPrefix = "_sub." + spPrefix
+
+// subtypeName returns the DNS-SD subtype name for tag in zone.
+func subtypeName(tag, zone string) string {
+	return fmt.Sprintf("_%s.%s%s", tag, subPrefix, zone)
+}
+
+// hasTag returns true if the peer with key is tagged with tag by the tag option
+// of zone.
+func hasTag(zone *Zone, key wgtypes.Key, tag string) bool {
+	return containsTag(zone.tags[key], tag)
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// peerTags returns the tags of the peer with key: those of the tag option of
+// zone, followed by the lowercase name of its device if device tags are
+// enabled.
+func peerTags(zone *Zone, peers *peerSet, key wgtypes.Key) []string {
+	tags := zone.tags[key]
+	if !zone.deviceTags {
+		return tags
+	}
+	tag := strings.ToLower(peers.origin(key))
+	if containsTag(tags, tag) {
+		return tags
+	}
+	return append(tags[:len(tags):len(tags)], tag)
+}
+
+// handleSubtype handles queries for _<tag>._sub._wireguard._udp.<zone>. The
+// name exists if at least one published peer is tagged with tag.
+func handleSubtype(state request.Request, zone *Zone, peers *peerSet) (int, error) {
+	tag := strings.TrimPrefix(
+		strings.TrimSuffix(state.Name(), "."+subPrefix+state.Zone), "_")
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	for _, peer := range peers.all() {
+		if peer.Endpoint == nil || !containsTag(peerTags(zone, peers, peer.PublicKey), tag) {
+			continue
+		}
+		m.Answer = append(m.Answer, getPTRRR(state.Name(),
+			peerInstanceName(zone, peer), zone.ttl.ptr))
+	}
+	if len(m.Answer) == 0 {
+		return nxDomain(state, zone)
+	}
+	if state.QType() != dns.TypePTR {
+		return noData(state, zone, dns.TypePTR)
+	}
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
+}
+
+// handleSubtypeParent handles queries for _sub._wireguard._udp.<zone>, which
+// is an empty non-terminal if any peers are tagged.
+func handleSubtypeParent(state request.Request, zone *Zone, peers *peerSet) (int, error) {
+	for _, peer := range peers.all() {
+		if peer.Endpoint != nil && len(peerTags(zone, peers, peer.PublicKey)) > 0 {
+			return noData(state, zone)
+		}
+	}
+	return nxDomain(state, zone)
+}
@@ -0,0 +1,180 @@
+package wgsd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// maxZoneVersions is the number of zone versions retained per zone for
+// computing IXFR differences.
+const maxZoneVersions = 16
+
+// zoneVersion is the content of a zone at a particular SOA serial.
+type zoneVersion struct {
+	serial uint32
+	rrs    []dns.RR // all RRs in the zone, except for the SOA RR
+}
+
+// zoneVersions is a bounded history of zone versions, oldest first.
+type zoneVersions struct {
+	mu       sync.Mutex
+	versions []zoneVersion
+}
+
+// add records rrs as the zone content at serial, replacing any previously
+// recorded content at the same serial.
+func (z *zoneVersions) add(serial uint32, rrs []dns.RR) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for i := range z.versions {
+		if z.versions[i].serial == serial {
+			z.versions[i].rrs = rrs
+			return
+		}
+	}
+	z.versions = append(z.versions, zoneVersion{serial: serial, rrs: rrs})
+	if len(z.versions) > maxZoneVersions {
+		z.versions = z.versions[len(z.versions)-maxZoneVersions:]
+	}
+}
+
+func (z *zoneVersions) get(serial uint32) ([]dns.RR, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, v := range z.versions {
+		if v.serial == serial {
+			return v.rrs, true
+		}
+	}
+	return nil, false
+}
+
+// zoneRRs returns all RRs in zone, except for the SOA RR.
+func zoneRRs(zone *Zone, peers *peerSet) []dns.RR {
+	var rrs []dns.RR
+	if zone.soaNS != "" {
+		rrs = append(rrs, ns(zone))
+	}
+	rrs = append(rrs, metaRRs(zone)...)
+	for _, peer := range peers.all() {
+		if zone.hosts {
+			for _, name := range hostNames(zone, peer) {
+				rrs = append(rrs, getTunnelHostRRs(zone, name, peer)...)
+			}
+		}
+		if peer.Endpoint == nil {
+			continue
+		}
+		if len(getHostRRs(zone, "", peer)) == 0 {
+			continue
+		}
+		target := peerInstanceName(zone, peer)
+		rrs = append(rrs, getPTRRR(spPrefix+zone.name, target, zone.ttl.ptr))
+		// peers with a friendly name are resolvable under both names
+		names := []string{instanceName(zone, peer)}
+		if friendly := friendlyInstanceName(zone, peer); friendly != "" {
+			names = append(names, friendly)
+		}
+		tags := peerTags(zone, peers, peer.PublicKey)
+		for _, name := range names {
+			rrs = append(rrs, getSRVRR(name, peer.Endpoint, zone.ttl.srv))
+			rrs = append(rrs, getHostRRs(zone, name, peer)...)
+			rrs = append(rrs, getTXTRR(zone, name, peer, tags))
+		}
+		for _, tag := range tags {
+			rrs = append(rrs, getPTRRR(subtypeName(tag, zone.name), target,
+				zone.ttl.ptr))
+		}
+	}
+	return rrs
+}
+
+// diffRRs returns the RRs present in from but not in to (deleted), and those
+// present in to but not in from (added).
+func diffRRs(from, to []dns.RR) (deleted, added []dns.RR) {
+	fromSet := make(map[string]bool, len(from))
+	for _, rr := range from {
+		fromSet[rr.String()] = true
+	}
+	toSet := make(map[string]bool, len(to))
+	for _, rr := range to {
+		toSet[rr.String()] = true
+		if !fromSet[rr.String()] {
+			added = append(added, rr)
+		}
+	}
+	for _, rr := range from {
+		if !toSet[rr.String()] {
+			deleted = append(deleted, rr)
+		}
+	}
+	return deleted, added
+}
+
+// Transfer implements the transfer.Transferer interface. Records for self are
+// only included when the self endpoint is configured, as there is no DNS query
+// to derive a local IP address from.
+func (p *WGSD) Transfer(zoneName string, serial uint32) (<-chan []dns.RR, error) {
+	match := plugin.Zones(p.Names).Matches(zoneName)
+	if match == "" || !strings.EqualFold(match, zoneName) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+	zone, ok := p.Z[match]
+	if !ok || zone.forward != nil || zone.glob != "" {
+		// transfers of reverse zones and sub-zones are not supported
+		return nil, transfer.ErrNotAuthoritative
+	}
+	if zone.soaNS == "" {
+		// secondaries reject zones without NS RRs
+		return nil, fmt.Errorf("transfer of zone %s requires the soa option", zone.name)
+	}
+
+	snapshot, err := p.snapshot(context.Background(), zone)
+	if err != nil {
+		return nil, err
+	}
+	current := zone.serial.update(snapshot.fingerprint)
+	rrs := zoneRRs(zone, getPeers(zone, snapshot, nil))
+	zone.versions.add(current, rrs)
+	soaRR := soa(zone)
+
+	ch := make(chan []dns.RR)
+	go func() {
+		defer close(ch)
+		if serial != 0 && serial >= current {
+			// IXFR for an up to date zone
+			ch <- []dns.RR{soaRR}
+			return
+		}
+		if serial != 0 {
+			previous, ok := zone.versions.get(serial)
+			if ok {
+				// IXFR, see RFC1995 section 4
+				oldSOA := dns.Copy(soaRR).(*dns.SOA)
+				oldSOA.Serial = serial
+				deleted, added := diffRRs(previous, rrs)
+				ch <- []dns.RR{soaRR, oldSOA}
+				if len(deleted) > 0 {
+					ch <- deleted
+				}
+				ch <- []dns.RR{soaRR}
+				if len(added) > 0 {
+					ch <- added
+				}
+				ch <- []dns.RR{soaRR}
+				return
+			}
+			// unknown serial, fall back to AXFR
+		}
+		ch <- []dns.RR{soaRR}
+		ch <- rrs
+		ch <- []dns.RR{soaRR}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,183 @@
+package wgsd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func collectTransfer(t *testing.T, p *WGSD, zone string, serial uint32) []dns.RR {
+	t.Helper()
+	ch, err := p.Transfer(zone, serial)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var rrs []dns.RR
+	for records := range ch {
+		rrs = append(rrs, records...)
+	}
+	return rrs
+}
+
+func TestTransfer(t *testing.T) {
+	selfKey := [32]byte{}
+	selfKey[0] = 99
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1Allowed, _ := constructAllowedIPs(t, []string{"10.0.0.1/32"})
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey:  key1,
+		AllowedIPs: peer1Allowed,
+	}
+	key2 := [32]byte{}
+	key2[0] = 2
+	peer2 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("::2"),
+			Port: 2,
+		},
+		PublicKey: key2,
+	}
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg0": {
+				Name:       "wg0",
+				PublicKey:  selfKey,
+				ListenPort: 51820,
+				Peers:      []wgtypes.Peer{peer1},
+			},
+		},
+	}
+	zone := &Zone{
+		name:      "example.com.",
+		devices:   []string{"wg0"},
+		ttl:       defaultTTLs,
+		serveSelf: true,
+		tags: map[wgtypes.Key][]string{
+			key2: {"gateway"},
+		},
+	}
+	p := &WGSD{
+		Next: test.ErrorHandler(),
+		Zones: Zones{
+			Names: []string{"example.com."},
+			Z: map[string]*Zone{
+				"example.com.": zone,
+			},
+		},
+		client: client,
+	}
+
+	_, err := p.Transfer("example.org.", 0)
+	if err != transfer.ErrNotAuthoritative {
+		t.Fatalf("expected ErrNotAuthoritative, got %v", err)
+	}
+	_, err = p.Transfer("sub.example.com.", 0)
+	if err != transfer.ErrNotAuthoritative {
+		t.Fatalf("expected ErrNotAuthoritative, got %v", err)
+	}
+
+	_, err = p.Transfer("example.com.", 0)
+	if err == nil {
+		t.Fatal("expected error for zone without configured nameserver")
+	}
+	zone.soaNS = "ns1.example.com."
+
+	peer1Name := instanceName(&Zone{name: "example.com."}, peer1)
+	axfr := collectTransfer(t, p, "example.com.", 0)
+	// self is excluded as it has no configured endpoint
+	want := []string{
+		soa(zone).String(),
+		ns(zone).String(),
+		"_services._dns-sd._udp.example.com.\t0\tIN\tPTR\t_wireguard._udp.example.com.",
+		"b._dns-sd._udp.example.com.\t0\tIN\tPTR\texample.com.",
+		"lb._dns-sd._udp.example.com.\t0\tIN\tPTR\texample.com.",
+		fmt.Sprintf("_wireguard._udp.example.com.\t0\tIN\tPTR\t%s", peer1Name),
+		fmt.Sprintf("%s\t0\tIN\tSRV\t0 0 1 %s", peer1Name, peer1Name),
+		fmt.Sprintf("%s\t0\tIN\tA\t1.1.1.1", peer1Name),
+		getTXTRR(zone, peer1Name, peer1, zone.tags[peer1.PublicKey]).String(),
+		soa(zone).String(),
+	}
+	if len(axfr) != len(want) {
+		t.Fatalf("expected %d RRs, got %d: %v", len(want), len(axfr), axfr)
+	}
+	for i := range want {
+		if axfr[i].String() != want[i] {
+			t.Errorf("RR %d: expected %q, got %q", i, want[i], axfr[i].String())
+		}
+	}
+	serial1 := axfr[0].(*dns.SOA).Serial
+
+	// IXFR for an up to date zone
+	ixfr := collectTransfer(t, p, "example.com.", serial1)
+	if len(ixfr) != 1 {
+		t.Fatalf("expected a single SOA RR, got %v", ixfr)
+	}
+	if ixfr[0].(*dns.SOA).Serial != serial1 {
+		t.Fatalf("expected serial %d, got %d", serial1, ixfr[0].(*dns.SOA).Serial)
+	}
+
+	// replace peer1 with peer2, and enable the self endpoint
+	client.devices["wg0"].Peers = []wgtypes.Peer{peer2}
+	zone.selfEndpoint = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	self := wgtypes.Peer{
+		PublicKey: selfKey,
+		Endpoint:  zone.selfEndpoint,
+	}
+	selfName := instanceName(&Zone{name: "example.com."}, self)
+	peer2Name := instanceName(&Zone{name: "example.com."}, peer2)
+	ixfr = collectTransfer(t, p, "example.com.", serial1)
+	if len(ixfr) < 3 {
+		t.Fatalf("expected IXFR response, got %v", ixfr)
+	}
+	serial2 := ixfr[0].(*dns.SOA).Serial
+	if serial2 <= serial1 {
+		t.Fatalf("expected serial to increase: %d <= %d", serial2, serial1)
+	}
+	// newSOA, oldSOA, deleted..., newSOA, added..., newSOA
+	want = []string{
+		soa(zone).String(),
+		fmt.Sprintf("example.com.\t60\tIN\tSOA\tns1.example.com. postmaster.example.com. %d 86400 7200 3600000 60", serial1),
+		fmt.Sprintf("_wireguard._udp.example.com.\t0\tIN\tPTR\t%s", peer1Name),
+		fmt.Sprintf("%s\t0\tIN\tSRV\t0 0 1 %s", peer1Name, peer1Name),
+		fmt.Sprintf("%s\t0\tIN\tA\t1.1.1.1", peer1Name),
+		getTXTRR(zone, peer1Name, peer1, zone.tags[peer1.PublicKey]).String(),
+		soa(zone).String(),
+		fmt.Sprintf("_wireguard._udp.example.com.\t0\tIN\tPTR\t%s", peer2Name),
+		fmt.Sprintf("%s\t0\tIN\tSRV\t0 0 2 %s", peer2Name, peer2Name),
+		fmt.Sprintf("%s\t0\tIN\tAAAA\t::2", peer2Name),
+		getTXTRR(zone, peer2Name, peer2, zone.tags[peer2.PublicKey]).String(),
+		fmt.Sprintf("_gateway._sub._wireguard._udp.example.com.\t0\tIN\tPTR\t%s", peer2Name),
+		fmt.Sprintf("_wireguard._udp.example.com.\t0\tIN\tPTR\t%s", selfName),
+		fmt.Sprintf("%s\t0\tIN\tSRV\t0 0 51820 %s", selfName, selfName),
+		fmt.Sprintf("%s\t0\tIN\tA\t192.0.2.1", selfName),
+		getTXTRR(zone, selfName, self, zone.tags[self.PublicKey]).String(),
+		soa(zone).String(),
+	}
+	if len(ixfr) != len(want) {
+		t.Fatalf("expected %d RRs, got %d: %v", len(want), len(ixfr), ixfr)
+	}
+	for i := range want {
+		if ixfr[i].String() != want[i] {
+			t.Errorf("RR %d: expected %q, got %q", i, want[i], ixfr[i].String())
+		}
+	}
+
+	// IXFR from an unknown serial falls back to AXFR
+	axfr = collectTransfer(t, p, "example.com.", serial1-1)
+	if len(axfr) != 15 {
+		t.Fatalf("expected AXFR fallback with 15 RRs, got %d: %v", len(axfr), axfr)
+	}
+	if _, ok := axfr[1].(*dns.NS); !ok {
+		t.Fatalf("expected NS RR following SOA in AXFR, got %v", axfr[1])
+	}
+}
@@ -0,0 +1,57 @@
+package wgsd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// tsigFudge is the permitted error in seconds between the time signed in a
+// TSIG RR and the time of verification.
+const tsigFudge = 300
+
+// tsigWriter is a dns.ResponseWriter that adds a TSIG RR to responses, so they
+// are signed by the server using the key of the request.
+type tsigWriter struct {
+	dns.ResponseWriter
+	reqTSIG *dns.TSIG
+}
+
+// WriteMsg implements the dns.ResponseWriter interface.
+func (t *tsigWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() == nil {
+		m.SetTsig(t.reqTSIG.Hdr.Name, t.reqTSIG.Algorithm, tsigFudge,
+			time.Now().Unix())
+	}
+	return t.ResponseWriter.WriteMsg(m)
+}
+
+// checkTSIG returns true if the request in state carries a valid TSIG RR made
+// with the key of zone.
+func checkTSIG(state request.Request, zone *Zone) bool {
+	reqTSIG := state.Req.IsTsig()
+	if reqTSIG == nil {
+		logger.Debugf("rejecting request for zone %s without TSIG", zone.name)
+		return false
+	}
+	if !strings.EqualFold(reqTSIG.Hdr.Name, zone.tsigKey) {
+		logger.Debugf("rejecting request for zone %s signed with key %s",
+			zone.name, reqTSIG.Hdr.Name)
+		return false
+	}
+	if err := state.W.TsigStatus(); err != nil {
+		logger.Debugf("rejecting request for zone %s with invalid TSIG: %v",
+			zone.name, err)
+		return false
+	}
+	return true
+}
+
+func refused(state request.Request) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, dns.RcodeRefused)
+	state.W.WriteMsg(m) // nolint: errcheck
+	return dns.RcodeSuccess, nil
+}
@@ -0,0 +1,128 @@
+package wgsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestTSIG(t *testing.T) {
+	const (
+		keyName = "key.example.com."
+		secret  = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+	)
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	p := &WGSD{
+		Next: test.ErrorHandler(),
+		Zones: Zones{
+			Names: []string{"example.com."},
+			Z: map[string]*Zone{
+				"example.com.": {
+					name:       "example.com.",
+					devices:    []string{"wg0"},
+					ttl:        defaultTTLs,
+					tsigKey:    keyName,
+					tsigSecret: secret,
+				},
+			},
+		},
+		client: &mockClient{
+			devices: map[string]*wgtypes.Device{
+				"wg0": {
+					Name:  "wg0",
+					Peers: []wgtypes.Peer{peer1},
+				},
+			},
+		},
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		TsigSecret: map[string]string{
+			keyName:              secret,
+			"other.example.com.": secret,
+		},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			p.ServeDNS(context.TODO(), w, r) // nolint: errcheck
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe() // nolint: errcheck
+	defer server.Shutdown()      // nolint: errcheck
+	<-started
+	addr := pc.LocalAddr().String()
+
+	query := func(tsigKey, tsigSecret string) (*dns.Msg, error) {
+		c := &dns.Client{Timeout: time.Second}
+		m := new(dns.Msg)
+		m.SetQuestion(instanceName(&Zone{name: "example.com."}, peer1), dns.TypeSRV)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		if tsigKey != "" {
+			c.TsigSecret = map[string]string{tsigKey: tsigSecret}
+			m.SetTsig(tsigKey, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		}
+		r, _, err := c.Exchange(m, addr)
+		return r, err
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		r, err := query(keyName, secret)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Fatalf("expected SRV answer, got %v", r)
+		}
+		if r.IsTsig() == nil {
+			t.Fatal("expected signed response")
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		r, err := query("", "")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if r.Rcode != dns.RcodeRefused {
+			t.Fatalf("expected REFUSED, got %s", dns.RcodeToString[r.Rcode])
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		r, err := query("other.example.com.", secret)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if r.Rcode != dns.RcodeRefused {
+			t.Fatalf("expected REFUSED, got %s", dns.RcodeToString[r.Rcode])
+		}
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		r, err := query(keyName, "d3JvbmdzZWNyZXQ=")
+		if r == nil {
+			t.Fatalf("expected response, got error %v", err)
+		}
+		if r.Rcode != dns.RcodeRefused {
+			t.Fatalf("expected REFUSED, got %s", dns.RcodeToString[r.Rcode])
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package wgsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// defaultUAPIDir is the directory containing the UAPI sockets of
+	// userspace WireGuard implementations such as wireguard-go and boringtun.
+	defaultUAPIDir = "/var/run/wireguard"
+
+	// uapiTimeout bounds the retrieval of a device via its UAPI socket.
+	uapiTimeout = 5 * time.Second
+)
+
+// uapiClient is a PeerSource retrieving devices of userspace WireGuard
+// implementations directly from their UAPI sockets, <dir>/<device>.sock, see
+// https://www.wireguard.com/xplatform/.
+type uapiClient struct {
+	dir string
+}
+
+// Device retrieves the device name via its UAPI socket.
+func (u *uapiClient) Device(ctx context.Context, name string) (*wgtypes.Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, uapiTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", filepath.Join(u.dir, name+".sock"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte("get=1\n\n")); err != nil {
+		return nil, err
+	}
+	device, err := parseUAPI(bufio.NewScanner(conn))
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving device %s: %v", name, err)
+	}
+	device.Name = name
+	return device, nil
+}
+
+// Devices retrieves all devices with a UAPI socket in the directory of u.
+// Sockets that fail, e.g. stale sockets of implementations that crashed, are
+// logged and skipped, so that they don't hide the other devices.
+func (u *uapiClient) Devices(ctx context.Context) ([]*wgtypes.Device, error) {
+	paths, err := filepath.Glob(filepath.Join(u.dir, "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*wgtypes.Device, 0, len(paths))
+	for _, path := range paths {
+		device, err := u.Device(ctx, strings.TrimSuffix(filepath.Base(path), ".sock"))
+		if err != nil {
+			logger.Errorf("skipping UAPI socket %s: %v", path, err)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// parseUAPI parses the response to a UAPI get operation, a list of key=value
+// lines terminated by an empty line. Device keys are followed by the keys of
+// each peer, starting with its public_key. Unknown keys are ignored.
+func parseUAPI(scanner *bufio.Scanner) (*wgtypes.Device, error) {
+	device := &wgtypes.Device{
+		Type: wgtypes.Userspace,
+	}
+	var peer *wgtypes.Peer
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if peer != nil {
+				device.Peers = append(device.Peers, *peer)
+			}
+			return device, nil
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line: %s", line)
+		}
+		var err error
+		switch key {
+		case "errno":
+			var errno int
+			errno, err = strconv.Atoi(value)
+			if err == nil && errno != 0 {
+				return nil, fmt.Errorf("errno %d", errno)
+			}
+		case "private_key":
+			device.PrivateKey, err = parseHexKey(value)
+			device.PublicKey = device.PrivateKey.PublicKey()
+		case "listen_port":
+			device.ListenPort, err = strconv.Atoi(value)
+		case "fwmark":
+			device.FirewallMark, err = strconv.Atoi(value)
+		case "public_key":
+			if peer != nil {
+				device.Peers = append(device.Peers, *peer)
+			}
+			peer = &wgtypes.Peer{}
+			peer.PublicKey, err = parseHexKey(value)
+		default:
+			if peer == nil {
+				break
+			}
+			err = parsePeerUAPI(peer, key, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s': %v", key, value, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("unexpected end of response")
+}
+
+// parsePeerUAPI sets the field of peer corresponding to the UAPI peer key.
+func parsePeerUAPI(peer *wgtypes.Peer, key, value string) error {
+	var err error
+	switch key {
+	case "preshared_key":
+		peer.PresharedKey, err = parseHexKey(value)
+	case "protocol_version":
+		peer.ProtocolVersion, err = strconv.Atoi(value)
+	case "endpoint":
+		peer.Endpoint, err = net.ResolveUDPAddr("udp", value)
+	case "last_handshake_time_sec":
+		var sec int64
+		sec, err = strconv.ParseInt(value, 10, 64)
+		if err == nil && sec != 0 {
+			peer.LastHandshakeTime = time.Unix(sec, 0)
+		}
+	case "last_handshake_time_nsec":
+		// follows last_handshake_time_sec, which is zero without a handshake
+		var nsec int64
+		nsec, err = strconv.ParseInt(value, 10, 64)
+		if err == nil && !peer.LastHandshakeTime.IsZero() {
+			peer.LastHandshakeTime = peer.LastHandshakeTime.Add(time.Duration(nsec))
+		}
+	case "rx_bytes":
+		peer.ReceiveBytes, err = strconv.ParseInt(value, 10, 64)
+	case "tx_bytes":
+		peer.TransmitBytes, err = strconv.ParseInt(value, 10, 64)
+	case "persistent_keepalive_interval":
+		var seconds int
+		seconds, err = strconv.Atoi(value)
+		peer.PersistentKeepaliveInterval = time.Duration(seconds) * time.Second
+	case "allowed_ip":
+		var prefix *net.IPNet
+		_, prefix, err = net.ParseCIDR(value)
+		if err == nil {
+			peer.AllowedIPs = append(peer.AllowedIPs, *prefix)
+		}
+	}
+	return err
+}
+
+// parseHexKey parses a hex-encoded key, as used by the UAPI.
+func parseHexKey(s string) (wgtypes.Key, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	return wgtypes.NewKey(b)
+}
@@ -0,0 +1,172 @@
+package wgsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// serveUAPI serves response to UAPI get operations on the socket at path
+// until the test ends.
+func serveUAPI(t *testing.T, path, response string) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("error listening on %s: %v", path, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			var request []string
+			for scanner.Scan() && scanner.Text() != "" {
+				request = append(request, scanner.Text())
+			}
+			if len(request) == 1 && request[0] == "get=1" {
+				conn.Write([]byte(response)) // nolint: errcheck
+			} else {
+				conn.Write([]byte("errno=22\n\n")) // nolint: errcheck
+			}
+			conn.Close()
+		}
+	}()
+}
+
+func TestUAPIClient(t *testing.T) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	key1 := [32]byte{}
+	key1[0] = 1
+	key2 := [32]byte{}
+	key2[0] = 2
+	_, prefix1, _ := net.ParseCIDR("10.0.0.1/32")
+	_, prefix2, _ := net.ParseCIDR("fd00::1/128")
+	handshake := time.Unix(1700000000, 500)
+
+	dir := t.TempDir()
+	serveUAPI(t, filepath.Join(dir, "wg0.sock"), fmt.Sprintf(`private_key=%s
+listen_port=51820
+fwmark=7
+public_key=%s
+endpoint=1.1.1.1:1
+last_handshake_time_sec=%d
+last_handshake_time_nsec=%d
+tx_bytes=2048
+rx_bytes=1024
+persistent_keepalive_interval=25
+protocol_version=1
+allowed_ip=10.0.0.1/32
+allowed_ip=fd00::1/128
+public_key=%s
+endpoint=[2001:db8::1]:2
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=0
+rx_bytes=0
+persistent_keepalive_interval=0
+protocol_version=1
+errno=0
+
+`, hex.EncodeToString(privateKey[:]), hex.EncodeToString(key1[:]),
+		handshake.Unix(), handshake.Nanosecond(), hex.EncodeToString(key2[:])))
+	serveUAPI(t, filepath.Join(dir, "wg1.sock"), "errno=19\n\n")
+
+	u := &uapiClient{dir: dir}
+	device, err := u.Device(context.Background(), "wg0")
+	if err != nil {
+		t.Fatalf("error retrieving device: %v", err)
+	}
+	want := &wgtypes.Device{
+		Name:         "wg0",
+		Type:         wgtypes.Userspace,
+		PrivateKey:   privateKey,
+		PublicKey:    privateKey.PublicKey(),
+		ListenPort:   51820,
+		FirewallMark: 7,
+		Peers: []wgtypes.Peer{
+			{
+				PublicKey: key1,
+				Endpoint: &net.UDPAddr{
+					IP:   net.ParseIP("1.1.1.1"),
+					Port: 1,
+				},
+				LastHandshakeTime:           handshake,
+				ReceiveBytes:                1024,
+				TransmitBytes:               2048,
+				PersistentKeepaliveInterval: 25 * time.Second,
+				AllowedIPs:                  []net.IPNet{*prefix1, *prefix2},
+				ProtocolVersion:             1,
+			},
+			{
+				PublicKey: key2,
+				Endpoint: &net.UDPAddr{
+					IP:   net.ParseIP("2001:db8::1"),
+					Port: 2,
+				},
+				ProtocolVersion: 1,
+			},
+		},
+	}
+	if !reflect.DeepEqual(device, want) {
+		t.Fatalf("expected %+v, got %+v", want, device)
+	}
+
+	if _, err := u.Device(context.Background(), "wg1"); err == nil {
+		t.Error("expected error for nonzero errno")
+	}
+	if _, err := u.Device(context.Background(), "wg2"); err == nil {
+		t.Error("expected error for missing socket")
+	}
+	// a stale socket nobody listens on
+	if err := os.WriteFile(filepath.Join(dir, "wg3.sock"), nil, 0600); err != nil {
+		t.Fatalf("error writing stale socket: %v", err)
+	}
+	devices, err := u.Devices(context.Background())
+	if err != nil || len(devices) != 1 || devices[0].Name != "wg0" {
+		t.Errorf("expected only wg0 listing devices including failing sockets, got %v, %v",
+			devices, err)
+	}
+
+	// handlers are served from the UAPI client of the zone
+	p := &WGSD{
+		Next: test.ErrorHandler(),
+		Zones: Zones{
+			Names: []string{"example.com."},
+			Z: map[string]*Zone{
+				"example.com.": {
+					name:    "example.com.",
+					devices: []string{"wg0"},
+					ttl:     defaultTTLs,
+					client:  u,
+				},
+			},
+		},
+		client: &mockClient{},
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("_wireguard._udp.example.com.", dns.TypePTR)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := p.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Answer) != 2 {
+		t.Errorf("expected 2 PTR answers, got %v", rec.Msg.Answer)
+	}
+}
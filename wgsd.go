@@ -1,12 +1,17 @@
 package wgsd
 
 import (
+	"bytes"
 	"context"
-	"encoding/base32"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
@@ -27,7 +32,8 @@ const (
 type WGSD struct {
 	Next plugin.Handler
 	Zones
-	client wgctrlClient // the client for retrieving WireGuard peer information
+	client     PeerSource       // the default source of WireGuard peer information
+	refreshers deviceRefreshers // background device refreshers of client
 }
 
 type Zones struct {
@@ -36,162 +42,392 @@ type Zones struct {
 }
 
 type Zone struct {
-	name           string       // the name of the zone we are authoritative for
-	device         string       // the WireGuard device name, e.g. wg0
-	serveSelf      bool         // flag to enable serving data about self
-	selfEndpoint   *net.UDPAddr // overrides the self endpoint value
-	selfAllowedIPs []net.IPNet  // self allowed IPs
+	name            string                   // the name of the zone we are authoritative for
+	devices         []string                 // the WireGuard device names, e.g. wg0, the first of which is self
+	serveSelf       bool                     // flag to enable serving data about self
+	selfEndpoint    *net.UDPAddr             // overrides the self endpoint value
+	selfAltEndpoint *net.UDPAddr             // self endpoint of the other address family
+	selfAllowedIPs  []net.IPNet              // self allowed IPs
+	soaNS           string                   // overrides the primary nameserver in the SOA & apex NS RRs
+	soaMbox         string                   // overrides the responsible mailbox in the SOA RR
+	ttl             ttls                     // TTLs of the RRs served for the zone
+	serial          zoneSerial               // tracks the SOA serial of the zone
+	versions        zoneVersions             // zone content history for IXFR
+	notifyInterval  time.Duration            // device polling interval for sending NOTIFY, 0 if disabled
+	refreshInterval time.Duration            // device snapshot refresh interval, 0 if disabled
+	publishInterval time.Duration            // interval of publishing the local devices to the source, 0 if disabled
+	keys            []*dnssecKey             // DNSSEC keys used to sign responses
+	tsigKey         string                   // name of the TSIG key required for queries, empty if disabled
+	tsigSecret      string                   // base64-encoded TSIG secret
+	tags            map[wgtypes.Key][]string // DNS-SD subtypes of peers by public key
+	metadata        peerMetadata             // optional peer metadata served in TXT RRs
+	endpoints       endpointCache            // most recent endpoint per address family of peers
+	names           map[wgtypes.Key]string   // friendly names of peers by public key
+	nameKeys        map[string]wgtypes.Key   // public keys of peers by lowercase friendly name
+	keyEncoding     keyEncoding              // encoding of public keys in the names of RRs
+	hosts           bool                     // flag to enable serving tunnel host names of peers
+	deviceTags      bool                     // flag to enable tagging peers with the name of their device
+	merged          mergedSnapshot           // the most recent snapshot of all devices, if more than one
+	glob            string                   // device name pattern, each matching device is served as a sub-zone
+	sub             subZones                 // the sub-zones of the devices matching glob
+	refresher       *deviceRefresher         // the snapshot source of a sub-zone if refresh is enabled
+	client          PeerSource               // overrides the source of the devices, e.g. UAPI sockets
+	refreshers      deviceRefreshers         // background device refreshers of client, if set
+	forward         *Zone                    // the forward zone of a reverse zone, nil for forward zones
 }
 
-type wgctrlClient interface {
-	Device(string) (*wgtypes.Device, error)
+// ttls contains the TTL values, in seconds, for the RRs served for a zone.
+type ttls struct {
+	ptr      uint32
+	srv      uint32
+	host     uint32
+	txt      uint32
+	negative uint32 // used for the SOA & NS RRs, and the SOA minimum field
+}
+
+var defaultTTLs = ttls{
+	negative: 60,
+}
+
+// zoneSerial tracks the SOA serial of a zone. The serial is bumped whenever the
+// fingerprint of the zone's WireGuard device changes.
+type zoneSerial struct {
+	mu          sync.Mutex
+	fingerprint [sha256.Size]byte
+	serial      uint32
+}
+
+// update sets the current fingerprint of the zone's device, bumping the serial
+// if it differs from the previous fingerprint. It returns the current serial.
+func (z *zoneSerial) update(fingerprint [sha256.Size]byte) uint32 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.serial != 0 && fingerprint == z.fingerprint {
+		return z.serial
+	}
+	z.fingerprint = fingerprint
+	// Prefer a timestamp so that the serial continues to increase across
+	// restarts, but never go backwards when changes are observed faster than
+	// once per second.
+	next := uint32(time.Now().Unix())
+	if next <= z.serial {
+		next = z.serial + 1
+	}
+	z.serial = next
+	return z.serial
+}
+
+func (z *zoneSerial) get() uint32 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.serial
+}
+
+// fingerprintDevice returns a digest of the device fields that are reflected in
+// the zone's RRs: the device's public key and listen port, and the public key,
+// endpoint, and allowed IPs of each peer.
+func fingerprintDevice(device *wgtypes.Device) [sha256.Size]byte {
+	peers := make([]wgtypes.Peer, len(device.Peers))
+	copy(peers, device.Peers)
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(peers[i].PublicKey[:], peers[j].PublicKey[:]) < 0
+	})
+	h := sha256.New()
+	h.Write(device.PublicKey[:])
+	binary.Write(h, binary.BigEndian, uint32(device.ListenPort)) // nolint: errcheck
+	for _, peer := range peers {
+		h.Write(peer.PublicKey[:])
+		if peer.Endpoint != nil {
+			h.Write([]byte(peer.Endpoint.String()))
+		}
+		h.Write([]byte{0})
+		for _, prefix := range peer.AllowedIPs {
+			h.Write([]byte(prefix.String()))
+			h.Write([]byte{','})
+		}
+		h.Write([]byte{0})
+	}
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
 }
 
 const (
-	keyLen             = 56 // the number of characters in a base32-encoded WireGuard public key
-	spPrefix           = "_wireguard._udp."
-	spSubPrefix        = "." + spPrefix
-	serviceInstanceLen = keyLen + len(spSubPrefix)
+	spPrefix    = "_wireguard._udp."
+	spSubPrefix = "." + spPrefix
+	udpPrefix   = "_udp."
+
+	// DNS-SD service type enumeration and browse domain names, see RFC6763
+	// sections 9 & 11.
+	dnssdPrefix        = "_dns-sd._udp."
+	servicesPrefix     = "_services." + dnssdPrefix
+	browsePrefix       = "b." + dnssdPrefix
+	legacyBrowsePrefix = "lb." + dnssdPrefix
 )
 
-type handlerFn func(state request.Request, peers []wgtypes.Peer) (int, error)
+type handlerFn func(state request.Request, zone *Zone, peers *peerSet) (int, error)
 
 func getHandlerFn(queryType uint16, name string) handlerFn {
 	switch {
+	case name == "":
+		return handleApex
 	case name == spPrefix && queryType == dns.TypePTR:
 		return handlePTR
-	case len(name) == serviceInstanceLen && queryType == dns.TypeSRV:
-		return handleSRV
-	case len(name) == len(spSubPrefix)+keyLen && (queryType == dns.TypeA ||
-		queryType == dns.TypeAAAA || queryType == dns.TypeTXT):
-		return handleHostOrTXT
+	case (name == servicesPrefix || name == browsePrefix ||
+		name == legacyBrowsePrefix) && queryType == dns.TypePTR:
+		return handleMetaPTR
+	case name == spPrefix || name == servicesPrefix || name == browsePrefix ||
+		name == legacyBrowsePrefix:
+		return handlePTRNoData
+	case name == udpPrefix || name == dnssdPrefix:
+		return handleEmptyNonTerminal
+	case name == subPrefix:
+		return handleSubtypeParent
+	case strings.HasSuffix(name, "."+subPrefix) && strings.HasPrefix(name, "_"):
+		return handleSubtype
+	case isInstanceName(name):
+		switch queryType {
+		case dns.TypeSRV:
+			return handleSRV
+		case dns.TypeA, dns.TypeAAAA, dns.TypeTXT:
+			return handleHostOrTXT
+		default:
+			return handleInstanceNoData
+		}
+	case isHostName(name):
+		return handleTunnelHost
 	default:
 		return nil
 	}
 }
 
-func handlePTR(state request.Request, peers []wgtypes.Peer) (int, error) {
+func handleApex(state request.Request, zone *Zone, _ *peerSet) (int, error) {
 	m := new(dns.Msg)
 	m.SetReply(state.Req)
 	m.Authoritative = true
-	for _, peer := range peers {
+	switch state.QType() {
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, soa(zone))
+	case dns.TypeNS:
+		if zone.soaNS == "" {
+			return noData(state, zone, apexTypes(zone)...)
+		}
+		m.Answer = append(m.Answer, ns(zone))
+	case dns.TypeDNSKEY:
+		if len(zone.keys) == 0 {
+			return noData(state, zone, apexTypes(zone)...)
+		}
+		m.Answer = append(m.Answer, dnskeyRRs(zone)...)
+	default:
+		return noData(state, zone, apexTypes(zone)...)
+	}
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
+}
+
+// apexTypes returns the RR types present at the apex of zone.
+func apexTypes(zone *Zone) []uint16 {
+	types := []uint16{dns.TypeSOA}
+	if zone.soaNS != "" {
+		types = append(types, dns.TypeNS)
+	}
+	if len(zone.keys) > 0 {
+		types = append(types, dns.TypeDNSKEY)
+	}
+	return types
+}
+
+// handleEmptyNonTerminal handles queries for names that own no RRs, but have
+// descendants that do, e.g. _udp.<zone>.
+func handleEmptyNonTerminal(state request.Request, zone *Zone, _ *peerSet) (int, error) {
+	return noData(state, zone)
+}
+
+// handlePTRNoData handles non-PTR queries for names that only own PTR RRs.
+func handlePTRNoData(state request.Request, zone *Zone, _ *peerSet) (int, error) {
+	return noData(state, zone, dns.TypePTR)
+}
+
+// handleMetaPTR handles PTR queries for the DNS-SD service type enumeration
+// and browse domain names.
+func handleMetaPTR(state request.Request, zone *Zone, _ *peerSet) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	for _, rr := range metaRRs(zone) {
+		if strings.EqualFold(rr.Header().Name, state.Name()) {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
+}
+
+// metaRRs returns the DNS-SD service type enumeration and browse domain PTR
+// RRs of zone. Browsing clients use them to discover _wireguard._udp.<zone>
+// without prior knowledge of it.
+func metaRRs(zone *Zone) []dns.RR {
+	return []dns.RR{
+		getPTRRR(servicesPrefix+zone.name, spPrefix+zone.name, zone.ttl.ptr),
+		getPTRRR(browsePrefix+zone.name, zone.name, zone.ttl.ptr),
+		getPTRRR(legacyBrowsePrefix+zone.name, zone.name, zone.ttl.ptr),
+	}
+}
+
+func handlePTR(state request.Request, zone *Zone, peers *peerSet) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	for _, peer := range peers.all() {
 		if peer.Endpoint == nil {
 			continue
 		}
-		m.Answer = append(m.Answer, &dns.PTR{
-			Hdr: dns.RR_Header{
-				Name:   state.Name(),
-				Rrtype: dns.TypePTR,
-				Class:  dns.ClassINET,
-				Ttl:    0,
-			},
-			Ptr: fmt.Sprintf("%s.%s%s",
-				strings.ToLower(base32.StdEncoding.EncodeToString(peer.PublicKey[:])),
-				spPrefix, state.Zone),
-		})
+		m.Answer = append(m.Answer, getPTRRR(state.Name(),
+			peerInstanceName(zone, peer), zone.ttl.ptr))
 	}
-	state.W.WriteMsg(m) // nolint: errcheck
+	writeMsg(state, zone, m)
 	return dns.RcodeSuccess, nil
 }
 
-func handleSRV(state request.Request, peers []wgtypes.Peer) (int, error) {
+// isInstanceName returns true if name, relative to the zone, is a single label
+// followed by _wireguard._udp. The label may be underscore-prefixed, as
+// base64url-encoded keys can be.
+func isInstanceName(name string) bool {
+	label := strings.TrimSuffix(name, spSubPrefix)
+	return label != name && label != "" && !strings.Contains(label, ".")
+}
+
+// instanceName returns the DNS-SD service instance name of peer in zone, with
+// the public key of peer in the key encoding of zone.
+func instanceName(zone *Zone, peer wgtypes.Peer) string {
+	return fmt.Sprintf("%s.%s%s", zone.keyEncoding.encode(peer.PublicKey),
+		spPrefix, zone.name)
+}
+
+// findPeer returns the peer whose service instance name is name, using either
+// its friendly name or its public key in any supported encoding. name must be
+// in the case it was queried with, see parseKeyLabel. Peers without an
+// endpoint are not published, so they are never found.
+func findPeer(zone *Zone, name string, peers *peerSet) (wgtypes.Peer, bool) {
+	peer, ok := lookupPeer(zone, name[:strings.Index(name, ".")], peers)
+	if !ok || peer.Endpoint == nil {
+		return wgtypes.Peer{}, false
+	}
+	return peer, true
+}
+
+func handleSRV(state request.Request, zone *Zone, peers *peerSet) (int, error) {
 	m := new(dns.Msg)
 	m.SetReply(state.Req)
 	m.Authoritative = true
-	pubKey := state.Name()[:keyLen]
-	for _, peer := range peers {
-		if strings.EqualFold(
-			base32.StdEncoding.EncodeToString(peer.PublicKey[:]), pubKey) {
-			endpoint := peer.Endpoint
-			if endpoint == nil {
-				return nxDomain(state)
-			}
-			hostRR := getHostRR(state.Name(), endpoint)
-			if hostRR == nil {
-				return nxDomain(state)
-			}
-			txtRR := getTXTRR(state.Name(), peer)
-			m.Extra = append(m.Extra, hostRR, txtRR)
-			m.Answer = append(m.Answer, &dns.SRV{
-				Hdr: dns.RR_Header{
-					Name:   state.Name(),
-					Rrtype: dns.TypeSRV,
-					Class:  dns.ClassINET,
-					Ttl:    0,
-				},
-				Priority: 0,
-				Weight:   0,
-				Port:     uint16(endpoint.Port),
-				Target:   state.Name(),
-			})
-			state.W.WriteMsg(m) // nolint: errcheck
-			return dns.RcodeSuccess, nil
-		}
+	peer, ok := findPeer(zone, state.QName(), peers)
+	if !ok {
+		return nxDomain(state, zone)
+	}
+	hostRRs := getHostRRs(zone, state.QName(), peer)
+	if len(hostRRs) == 0 {
+		return nxDomain(state, zone)
 	}
-	return nxDomain(state)
+	txtRR := getMetadataTXTRR(zone, state.QName(), peer,
+		peerTags(zone, peers, peer.PublicKey))
+	m.Extra = append(m.Extra, hostRRs...)
+	m.Extra = append(m.Extra, txtRR)
+	m.Answer = append(m.Answer, getSRVRR(state.QName(), peer.Endpoint, zone.ttl.srv))
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
 }
 
-func handleHostOrTXT(state request.Request, peers []wgtypes.Peer) (int, error) {
+func handleHostOrTXT(state request.Request, zone *Zone, peers *peerSet) (int, error) {
 	m := new(dns.Msg)
 	m.SetReply(state.Req)
 	m.Authoritative = true
-	pubKey := state.Name()[:keyLen]
-	for _, peer := range peers {
-		if strings.EqualFold(
-			base32.StdEncoding.EncodeToString(peer.PublicKey[:]), pubKey) {
-			endpoint := peer.Endpoint
-			if endpoint == nil {
-				return nxDomain(state)
-			}
-			if state.QType() == dns.TypeA || state.QType() == dns.TypeAAAA {
-				hostRR := getHostRR(state.Name(), endpoint)
-				if hostRR == nil {
-					return nxDomain(state)
-				}
+	peer, ok := findPeer(zone, state.QName(), peers)
+	if !ok {
+		return nxDomain(state, zone)
+	}
+	if state.QType() == dns.TypeA || state.QType() == dns.TypeAAAA {
+		hostRRs := getHostRRs(zone, state.QName(), peer)
+		if len(hostRRs) == 0 {
+			return nxDomain(state, zone)
+		}
+		for _, hostRR := range hostRRs {
+			if hostRR.Header().Rrtype == state.QType() {
 				m.Answer = append(m.Answer, hostRR)
-			} else {
-				txtRR := getTXTRR(state.Name(), peer)
-				m.Answer = append(m.Answer, txtRR)
 			}
-			state.W.WriteMsg(m) // nolint: errcheck
-			return dns.RcodeSuccess, nil
 		}
+		if len(m.Answer) == 0 {
+			// no endpoint of the queried address family is known
+			return noData(state, zone, instanceTypes(zone, peer)...)
+		}
+	} else {
+		txtRR := getMetadataTXTRR(zone, state.QName(), peer,
+			peerTags(zone, peers, peer.PublicKey))
+		m.Answer = append(m.Answer, txtRR)
 	}
-	return nxDomain(state)
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
 }
 
-func getSelfPeer(zone *Zone, device *wgtypes.Device, state request.Request) (wgtypes.Peer, error) {
-	self := wgtypes.Peer{
+func handleInstanceNoData(state request.Request, zone *Zone, peers *peerSet) (int, error) {
+	peer, ok := findPeer(zone, state.QName(), peers)
+	if !ok {
+		return nxDomain(state, zone)
+	}
+	return noData(state, zone, instanceTypes(zone, peer)...)
+}
+
+// instanceTypes returns the RR types present at the service instance name of
+// peer.
+func instanceTypes(zone *Zone, peer wgtypes.Peer) []uint16 {
+	types := []uint16{dns.TypeSRV, dns.TypeTXT}
+	for _, hostRR := range getHostRRs(zone, "", peer) {
+		types = append(types, hostRR.Header().Rrtype)
+	}
+	return types
+}
+
+// getSelfPeer returns the peer representing the local WireGuard device. If no
+// self endpoint is configured localIP is used as the endpoint IP address. ok is
+// false if neither is available.
+func getSelfPeer(zone *Zone, device *wgtypes.Device, localIP net.IP) (
+	self wgtypes.Peer, ok bool) {
+	self = wgtypes.Peer{
 		PublicKey: device.PublicKey,
 	}
 	if zone.selfEndpoint != nil {
 		self.Endpoint = zone.selfEndpoint
 	} else {
+		if localIP == nil {
+			return self, false
+		}
 		self.Endpoint = &net.UDPAddr{
-			IP:   net.ParseIP(state.LocalIP()),
+			IP:   localIP,
 			Port: device.ListenPort,
 		}
 	}
 	self.AllowedIPs = zone.selfAllowedIPs
-	return self, nil
+	return self, true
 }
 
-func getPeers(client wgctrlClient, zone *Zone, state request.Request) (
-	[]wgtypes.Peer, error) {
-	peers := make([]wgtypes.Peer, 0)
-	device, err := client.Device(zone.device)
-	if err != nil {
-		return nil, err
+// getPeers returns the peers of snapshot, including self if enabled for zone.
+// localIP is the local IP address of the DNS query, which may be nil. Reverse
+// zones serve the peers of their forward zone.
+func getPeers(zone *Zone, snapshot *deviceSnapshot, localIP net.IP) *peerSet {
+	if zone.forward != nil {
+		zone = zone.forward
 	}
-	peers = append(peers, device.Peers...)
+	peers := &peerSet{snapshot: snapshot}
 	if zone.serveSelf {
-		self, err := getSelfPeer(zone, device, state)
-		if err != nil {
-			return nil, err
+		self, ok := getSelfPeer(zone, snapshot.device, localIP)
+		if ok {
+			peers.self = &self
 		}
-		peers = append(peers, self)
+		// Only configured endpoints are remembered. localIP is specific to
+		// the query, and must not be served in answers to other clients.
+		zone.endpoints.remember(snapshot.device.PublicKey, zone.selfEndpoint)
+		zone.endpoints.remember(snapshot.device.PublicKey, zone.selfAltEndpoint)
 	}
-	return peers, nil
+	return peers
 }
 
 func (p *WGSD) ServeDNS(ctx context.Context, w dns.ResponseWriter,
@@ -213,27 +449,93 @@ func (p *WGSD) ServeDNS(ctx context.Context, w dns.ResponseWriter,
 		return dns.RcodeServerFailure, nil
 	}
 
+	if zone.tsigKey != "" {
+		if !checkTSIG(state, zone) {
+			return refused(state)
+		}
+		state.W = &tsigWriter{ResponseWriter: w, reqTSIG: r.IsTsig()}
+	}
+
 	// strip zone from name
 	name := strings.TrimSuffix(state.Name(), zoneName)
 	queryType := state.QType()
 
+	if zone.glob != "" {
+		sub, subName := zone.subZone(name)
+		if sub == nil {
+			// the parent of the sub-zones only owns the apex RRs
+			if name == "" {
+				return handleApex(state, zone, nil)
+			}
+			return nxDomain(state, zone)
+		}
+		zone, name = sub, subName
+		state.Zone = zone.name
+	}
+
 	logger.Debugf("received query for: %s type: %s", name,
 		dns.TypeToString[queryType])
 
-	handler := getHandlerFn(queryType, name)
+	snapshot, err := p.snapshot(ctx, zone)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	zone.serial.update(snapshot.fingerprint)
+
+	var handler handlerFn
+	if zone.forward != nil {
+		handler = getReverseHandlerFn(name)
+	} else {
+		handler = getHandlerFn(queryType, name)
+	}
 	if handler == nil {
-		return nxDomain(state)
+		return nxDomain(state, zone)
 	}
 
-	peers, err := getPeers(p.client, zone, state)
-	if err != nil {
-		return dns.RcodeServerFailure, err
+	peers := getPeers(zone, snapshot, net.ParseIP(state.LocalIP()))
+
+	return handler(state, zone, peers)
+}
+
+func getPTRRR(name, target string, ttl uint32) dns.RR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ptr: target,
 	}
+}
 
-	return handler(state, peers)
+func getSRVRR(name string, endpoint *net.UDPAddr, ttl uint32) dns.RR {
+	return &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Priority: 0,
+		Weight:   0,
+		Port:     uint16(endpoint.Port),
+		Target:   name,
+	}
+}
+
+// getHostRRs returns the A and/or AAAA RRs for the endpoints of peer.
+func getHostRRs(zone *Zone, name string, peer wgtypes.Peer) []dns.RR {
+	var rrs []dns.RR
+	for _, endpoint := range zone.endpoints.get(peer) {
+		if hostRR := getHostRR(name, endpoint, zone.ttl.host); hostRR != nil {
+			rrs = append(rrs, hostRR)
+		}
+	}
+	return rrs
 }
 
-func getHostRR(name string, endpoint *net.UDPAddr) dns.RR {
+func getHostRR(name string, endpoint *net.UDPAddr, ttl uint32) dns.RR {
 	switch {
 	case endpoint.IP.To4() != nil:
 		return &dns.A{
@@ -241,7 +543,7 @@ func getHostRR(name string, endpoint *net.UDPAddr) dns.RR {
 				Name:   name,
 				Rrtype: dns.TypeA,
 				Class:  dns.ClassINET,
-				Ttl:    0,
+				Ttl:    ttl,
 			},
 			A: endpoint.IP,
 		}
@@ -251,7 +553,7 @@ func getHostRR(name string, endpoint *net.UDPAddr) dns.RR {
 				Name:   name,
 				Rrtype: dns.TypeAAAA,
 				Class:  dns.ClassINET,
-				Ttl:    0,
+				Ttl:    ttl,
 			},
 			AAAA: endpoint.IP,
 		}
@@ -266,58 +568,179 @@ const (
 	// clients with maintaining backwards compatibility.
 	//
 	// https://tools.ietf.org/html/rfc6763#section-6.7
-	txtVersion = 1
+	//
+	// Version 2 splits allowed IPs across the allowed, allowed1, allowed2, ...
+	// keys so no character-string exceeds maxTXTStringLen.
+	txtVersion = 2
+
+	// maxTXTStringLen is the maximum length of a character-string in a TXT RR.
+	maxTXTStringLen = 255
 )
 
-func getTXTRR(name string, peer wgtypes.Peer) *dns.TXT {
-	var allowedIPs string
-	for i, prefix := range peer.AllowedIPs {
-		if i != 0 {
-			allowedIPs += ","
+// allowedTXT returns the key/value pairs carrying prefixes in the TXT RR. The
+// first pair uses the key allowed, which is present even if prefixes is empty.
+// Subsequent pairs use the keys allowed1, allowed2, and so on.
+func allowedTXT(prefixes []net.IPNet) []string {
+	var txt []string
+	kv := "allowed="
+	empty := true
+	for _, prefix := range prefixes {
+		p := prefix.String()
+		if !empty && len(kv)+1+len(p) > maxTXTStringLen {
+			txt = append(txt, kv)
+			kv = fmt.Sprintf("allowed%d=", len(txt))
+			empty = true
+		}
+		if !empty {
+			kv += ","
 		}
-		allowedIPs += prefix.String()
+		kv += p
+		empty = false
+	}
+	return append(txt, kv)
+}
+
+// getTXTRR returns the TXT RR for peer, carrying its public key, allowed IPs,
+// and tags.
+func getTXTRR(zone *Zone, name string, peer wgtypes.Peer, tags []string) *dns.TXT {
+	txt := []string{
+		fmt.Sprintf("txtvers=%d", txtVersion),
+		fmt.Sprintf("pub=%s",
+			base64.StdEncoding.EncodeToString(peer.PublicKey[:])),
+	}
+	txt = append(txt, allowedTXT(peer.AllowedIPs)...)
+	if len(tags) > 0 {
+		txt = append(txt, fmt.Sprintf("tags=%s", strings.Join(tags, ",")))
 	}
 	return &dns.TXT{
 		Hdr: dns.RR_Header{
 			Name:   name,
 			Rrtype: dns.TypeTXT,
 			Class:  dns.ClassINET,
-			Ttl:    0,
-		},
-		Txt: []string{
-			fmt.Sprintf("txtvers=%d", txtVersion),
-			fmt.Sprintf("pub=%s",
-				base64.StdEncoding.EncodeToString(peer.PublicKey[:])),
-			fmt.Sprintf("allowed=%s", allowedIPs),
+			Ttl:    zone.ttl.txt,
 		},
+		Txt: txt,
 	}
 }
 
-func nxDomain(state request.Request) (int, error) {
+// writeMsg writes m to the client, signing it first if DNSSEC is enabled for
+// zone and requested by the client. m is truncated to the EDNS0 buffer size
+// advertised by the client, or 512 bytes in its absence.
+func writeMsg(state request.Request, zone *Zone, m *dns.Msg) {
+	if signing(state, zone) {
+		m.Answer = signRRs(zone, m.Answer)
+		m.Ns = signRRs(zone, m.Ns)
+		m.Extra = signRRs(zone, m.Extra)
+	}
+	state.SizeAndDo(m)
+	size := state.Size()
+	if zone.tsigKey != "" {
+		// leave room for the TSIG RR added by tsigWriter
+		size -= dns.Len(state.Req.IsTsig())
+	}
+	if state.Proto() == "tcp" {
+		// A truncated response can't be retried over TCP, so rather than
+		// serving a partial answer, e.g. the PTR RRs of a mesh of thousands
+		// of peers, fail. Such meshes can be enumerated via zone transfers.
+		m.Compress = true
+		if m.Len() > size {
+			logger.Warningf("response to %s %s with %d RRs exceeds the maximum "+
+				"message size, use zone transfers to enumerate large meshes",
+				state.Name(), state.Type(), len(m.Answer)+len(m.Ns)+len(m.Extra))
+			m = new(dns.Msg)
+			m.SetRcode(state.Req, dns.RcodeServerFailure)
+			state.SizeAndDo(m)
+		}
+		state.W.WriteMsg(m) // nolint: errcheck
+		return
+	}
+	// Truncate sets the TC bit if any RRs do not fit, so that the client
+	// retries over TCP.
+	m.Truncate(size)
+	state.W.WriteMsg(m) // nolint: errcheck
+}
+
+// nxDomain responds to a query for a name that does not exist. If the response
+// is signed, compact denial of existence is used, see RFC9824.
+func nxDomain(state request.Request, zone *Zone) (int, error) {
 	m := new(dns.Msg)
 	m.SetReply(state.Req)
 	m.Authoritative = true
 	m.Rcode = dns.RcodeNameError
-	m.Ns = []dns.RR{soa(state.Zone)}
-	state.W.WriteMsg(m) // nolint: errcheck
+	m.Ns = []dns.RR{soa(zone)}
+	if signing(state, zone) {
+		m.Rcode = dns.RcodeSuccess
+		m.Ns = append(m.Ns, compactNSEC(zone, state.Name(), typeNXNAME))
+	}
+	writeMsg(state, zone, m)
+	return dns.RcodeSuccess, nil
+}
+
+// noData responds to a query for a name that exists, but that has no RRs of
+// the queried type. types are the RR types that do exist at the name.
+func noData(state request.Request, zone *Zone, types ...uint16) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	m.Ns = []dns.RR{soa(zone)}
+	if signing(state, zone) {
+		m.Ns = append(m.Ns, compactNSEC(zone, state.Name(), types...))
+	}
+	writeMsg(state, zone, m)
 	return dns.RcodeSuccess, nil
 }
 
-func soa(zone string) dns.RR {
+// nameserver returns the primary nameserver served in the SOA RR. The apex NS
+// RR is only served if it is configured, as wgsd does not serve the default,
+// which would make the delegation lame.
+func (z *Zone) nameserver() string {
+	if z.soaNS != "" {
+		return z.soaNS
+	}
+	if z.forward != nil {
+		return z.forward.nameserver()
+	}
+	return fmt.Sprintf("ns1.%s", z.name)
+}
+
+func (z *Zone) mailbox() string {
+	if z.soaMbox != "" {
+		return z.soaMbox
+	}
+	if z.forward != nil {
+		return z.forward.mailbox()
+	}
+	return fmt.Sprintf("postmaster.%s", z.name)
+}
+
+func soa(zone *Zone) dns.RR {
 	return &dns.SOA{
 		Hdr: dns.RR_Header{
-			Name:   zone,
+			Name:   zone.name,
 			Rrtype: dns.TypeSOA,
 			Class:  dns.ClassINET,
-			Ttl:    60,
+			Ttl:    zone.ttl.negative,
 		},
-		Ns:      fmt.Sprintf("ns1.%s", zone),
-		Mbox:    fmt.Sprintf("postmaster.%s", zone),
-		Serial:  1,
+		Ns:      zone.nameserver(),
+		Mbox:    zone.mailbox(),
+		Serial:  zone.serial.get(),
 		Refresh: 86400,
 		Retry:   7200,
 		Expire:  3600000,
-		Minttl:  60,
+		Minttl:  zone.ttl.negative,
+	}
+}
+
+// ns returns the apex NS RR of zone, which must have a configured nameserver.
+func ns(zone *Zone) dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   zone.name,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    zone.ttl.negative,
+		},
+		Ns: zone.nameserver(),
 	}
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"strings"
@@ -19,10 +20,18 @@ type mockClient struct {
 	devices map[string]*wgtypes.Device
 }
 
-func (m *mockClient) Device(d string) (*wgtypes.Device, error) {
+func (m *mockClient) Device(_ context.Context, d string) (*wgtypes.Device, error) {
 	return m.devices[d], nil
 }
 
+func (m *mockClient) Devices(_ context.Context) ([]*wgtypes.Device, error) {
+	devices := make([]*wgtypes.Device, 0, len(m.devices))
+	for _, device := range m.devices {
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
 func constructAllowedIPs(t *testing.T, prefixes []string) ([]net.IPNet, string) {
 	var allowed []net.IPNet
 	var allowedString string
@@ -84,14 +93,30 @@ func TestWGSD(t *testing.T) {
 	p := &WGSD{
 		Next: test.ErrorHandler(),
 		Zones: Zones{
-			Names: []string{"example.com."},
+			Names: []string{"example.com.", "example.net."},
 			Z: map[string]*Zone{
 				"example.com.": {
 					name:           "example.com.",
-					device:         "wg0",
+					devices:        []string{"wg0"},
+					ttl:            defaultTTLs,
 					serveSelf:      true,
 					selfAllowedIPs: selfAllowed,
 				},
+				"example.net.": {
+					name:    "example.net.",
+					devices: []string{"wg0"},
+					ttl: ttls{
+						ptr:      1,
+						srv:      2,
+						host:     3,
+						txt:      4,
+						negative: 5,
+					},
+					tags: map[wgtypes.Key][]string{
+						key2: {"gateway", "linux"},
+						key3: {"build"},
+					},
+				},
 			},
 		},
 		client: &mockClient{
@@ -201,12 +226,202 @@ func TestWGSD(t *testing.T) {
 				test.TXT(fmt.Sprintf(`%s._wireguard._udp.example.com. 0 IN TXT "txtvers=%d" "pub=%s" "allowed=%s"`, peer2b32, txtVersion, peer2b64, peer2AllowedString)),
 			},
 		},
+		{
+			Qname: "example.com.",
+			Qtype: dns.TypeSOA,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SOA("example.com. 60 IN SOA ns1.example.com. postmaster.example.com. 1 86400 7200 3600000 60"),
+			},
+		},
+		{
+			// NS is only served if the nameserver is configured
+			Qname: "example.com.",
+			Qtype: dns.TypeNS,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: "example.com.",
+			Qtype: dns.TypeTXT,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: "_udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: "_wireguard._udp.example.com.",
+			Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: fmt.Sprintf("%s._wireguard._udp.example.com.", peer1b32),
+			Qtype: dns.TypeAAAA,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: fmt.Sprintf("%s._wireguard._udp.example.com.", peer2b32),
+			Qtype: dns.TypeMX,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: fmt.Sprintf("%s._wireguard._udp.example.com.", peer3b32),
+			Qtype: dns.TypeMX,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: "_services._dns-sd._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR("_services._dns-sd._udp.example.com. 0 IN PTR _wireguard._udp.example.com."),
+			},
+		},
+		{
+			Qname: "b._dns-sd._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR("b._dns-sd._udp.example.com. 0 IN PTR example.com."),
+			},
+		},
+		{
+			Qname: "lb._dns-sd._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR("lb._dns-sd._udp.example.com. 0 IN PTR example.com."),
+			},
+		},
+		{
+			Qname: "b._dns-sd._udp.example.com.",
+			Qtype: dns.TypeTXT,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: "_dns-sd._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: "db._dns-sd._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: "_wireguard._udp.example.net.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.net. 1 IN PTR %s._wireguard._udp.example.net.", peer1b32)),
+				test.PTR(fmt.Sprintf("_wireguard._udp.example.net. 1 IN PTR %s._wireguard._udp.example.net.", peer2b32)),
+			},
+		},
+		{
+			Qname: fmt.Sprintf("%s._wireguard._udp.example.net.", peer1b32),
+			Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.SRV(fmt.Sprintf("%s._wireguard._udp.example.net. 2 IN SRV 0 0 1 %s._wireguard._udp.example.net.", peer1b32, peer1b32)),
+			},
+			Extra: []dns.RR{
+				test.A(fmt.Sprintf("%s._wireguard._udp.example.net. 3 IN A %s", peer1b32, peer1.Endpoint.IP.String())),
+				test.TXT(fmt.Sprintf(`%s._wireguard._udp.example.net. 4 IN TXT "txtvers=%d" "pub=%s" "allowed=%s"`, peer1b32, txtVersion, peer1b64, peer1AllowedString)),
+			},
+		},
+		{
+			Qname: "_gateway._sub._wireguard._udp.example.net.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.PTR(fmt.Sprintf("_gateway._sub._wireguard._udp.example.net. 1 IN PTR %s._wireguard._udp.example.net.", peer2b32)),
+			},
+		},
+		{
+			Qname: "_gateway._sub._wireguard._udp.example.net.",
+			Qtype: dns.TypeTXT,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.net."]).String()),
+			},
+		},
+		{
+			Qname: "_build._sub._wireguard._udp.example.net.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.net."]).String()),
+			},
+		},
+		{
+			Qname: "_sub._wireguard._udp.example.net.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeSuccess,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.net."]).String()),
+			},
+		},
+		{
+			Qname: "_sub._wireguard._udp.example.com.",
+			Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA(soa(p.Z["example.com."]).String()),
+			},
+		},
+		{
+			Qname: fmt.Sprintf("%s._wireguard._udp.example.net.", peer2b32),
+			Qtype: dns.TypeTXT,
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				test.TXT(fmt.Sprintf(`%s._wireguard._udp.example.net. 4 IN TXT "txtvers=%d" "pub=%s" "allowed=%s" "tags=gateway,linux"`, peer2b32, txtVersion, peer2b64, peer2AllowedString)),
+			},
+		},
+		{
+			Qname: "nxdomain.example.net.",
+			Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.net. 5 IN SOA ns1.example.net. postmaster.example.net. 1 86400 7200 3600000 5"),
+			},
+		},
 		{
 			Qname: "nxdomain.example.com.",
 			Qtype: dns.TypeAAAA,
 			Rcode: dns.RcodeNameError,
 			Ns: []dns.RR{
-				test.SOA(soa("example.com.").String()),
+				test.SOA(soa(p.Z["example.com."]).String()),
 			},
 		},
 		{
@@ -219,7 +434,7 @@ func TestWGSD(t *testing.T) {
 			Qtype: dns.TypeSRV,
 			Rcode: dns.RcodeNameError,
 			Ns: []dns.RR{
-				test.SOA(soa("example.com.").String()),
+				test.SOA(soa(p.Z["example.com."]).String()),
 			},
 			Answer: []dns.RR{},
 			Extra:  []dns.RR{},
@@ -229,7 +444,7 @@ func TestWGSD(t *testing.T) {
 			Qtype: dns.TypeA,
 			Rcode: dns.RcodeNameError,
 			Ns: []dns.RR{
-				test.SOA(soa("example.com.").String()),
+				test.SOA(soa(p.Z["example.com."]).String()),
 			},
 			Answer: []dns.RR{},
 			Extra:  []dns.RR{},
@@ -239,7 +454,7 @@ func TestWGSD(t *testing.T) {
 			Qtype: dns.TypeAAAA,
 			Rcode: dns.RcodeNameError,
 			Ns: []dns.RR{
-				test.SOA(soa("example.com.").String()),
+				test.SOA(soa(p.Z["example.com."]).String()),
 			},
 			Answer: []dns.RR{},
 			Extra:  []dns.RR{},
@@ -249,7 +464,7 @@ func TestWGSD(t *testing.T) {
 			Qtype: dns.TypeTXT,
 			Rcode: dns.RcodeNameError,
 			Ns: []dns.RR{
-				test.SOA(soa("example.com.").String()),
+				test.SOA(soa(p.Z["example.com."]).String()),
 			},
 			Answer: []dns.RR{},
 			Extra:  []dns.RR{},
@@ -282,3 +497,350 @@ func TestWGSD(t *testing.T) {
 		})
 	}
 }
+
+func TestZoneSerial(t *testing.T) {
+	key1 := [32]byte{}
+	key1[0] = 1
+	peer1 := wgtypes.Peer{
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP("1.1.1.1"),
+			Port: 1,
+		},
+		PublicKey: key1,
+	}
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg0": {
+				Name:  "wg0",
+				Peers: []wgtypes.Peer{peer1},
+			},
+		},
+	}
+	p := &WGSD{
+		Next: test.ErrorHandler(),
+		Zones: Zones{
+			Names: []string{"example.com."},
+			Z: map[string]*Zone{
+				"example.com.": {
+					name:    "example.com.",
+					devices: []string{"wg0"},
+					ttl:     defaultTTLs,
+				},
+			},
+		},
+		client: client,
+	}
+
+	querySerial := func() uint32 {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeSOA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := p.ServeDNS(context.TODO(), rec, m)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Fatalf("expected 1 answer, got %d", len(rec.Msg.Answer))
+		}
+		return rec.Msg.Answer[0].(*dns.SOA).Serial
+	}
+
+	serial := querySerial()
+	if serial == 0 {
+		t.Fatal("expected non-zero serial")
+	}
+	if got := querySerial(); got != serial {
+		t.Fatalf("serial changed without peer changes: %d != %d", got, serial)
+	}
+
+	peer1.Endpoint = &net.UDPAddr{
+		IP:   net.ParseIP("1.1.1.1"),
+		Port: 2,
+	}
+	client.devices["wg0"].Peers = []wgtypes.Peer{peer1}
+	next := querySerial()
+	if next <= serial {
+		t.Fatalf("expected serial to increase after endpoint change: %d <= %d", next, serial)
+	}
+	serial = next
+
+	key2 := [32]byte{}
+	key2[0] = 2
+	client.devices["wg0"].Peers = []wgtypes.Peer{peer1, {PublicKey: key2}}
+	next = querySerial()
+	if next <= serial {
+		t.Fatalf("expected serial to increase after peer addition: %d <= %d", next, serial)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	newWGSD := func(numPeers int) *WGSD {
+		peers := make([]wgtypes.Peer, 0, numPeers)
+		for i := 0; i < numPeers; i++ {
+			key := [32]byte{}
+			key[0] = byte(i >> 8)
+			key[1] = byte(i)
+			peers = append(peers, wgtypes.Peer{
+				Endpoint: &net.UDPAddr{
+					IP:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+					Port: 51820,
+				},
+				PublicKey: key,
+			})
+		}
+		return &WGSD{
+			Next: test.ErrorHandler(),
+			Zones: Zones{
+				Names: []string{"example.com."},
+				Z: map[string]*Zone{
+					"example.com.": {
+						name:    "example.com.",
+						devices: []string{"wg0"},
+						ttl:     defaultTTLs,
+					},
+				},
+			},
+			client: &mockClient{
+				devices: map[string]*wgtypes.Device{
+					"wg0": {
+						Name:  "wg0",
+						Peers: peers,
+					},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		numPeers    int
+		tcp         bool
+		bufSize     uint16 // 0 for no EDNS0
+		maxSize     int
+		wantAnswers int // 0 for truncated
+		wantFailure bool
+	}{
+		{
+			name:     "udp without edns0",
+			numPeers: 50,
+			maxSize:  dns.MinMsgSize,
+		},
+		{
+			name:     "udp with edns0",
+			numPeers: 500,
+			bufSize:  4096,
+			maxSize:  4096,
+		},
+		{
+			name:        "udp with edns0 fits",
+			numPeers:    5,
+			bufSize:     4096,
+			maxSize:     4096,
+			wantAnswers: 5,
+		},
+		{
+			name:        "tcp fits",
+			numPeers:    500,
+			tcp:         true,
+			maxSize:     dns.MaxMsgSize,
+			wantAnswers: 500,
+		},
+		{
+			name:        "tcp fits 900 peers",
+			numPeers:    900,
+			tcp:         true,
+			maxSize:     dns.MaxMsgSize,
+			wantAnswers: 900,
+		},
+		{
+			// a partial answer can't be retried over TCP
+			name:        "tcp exceeds maximum message size",
+			numPeers:    2000,
+			tcp:         true,
+			maxSize:     dns.MaxMsgSize,
+			wantFailure: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newWGSD(tc.numPeers)
+			m := new(dns.Msg)
+			m.SetQuestion(spPrefix+"example.com.", dns.TypePTR)
+			if tc.bufSize > 0 {
+				m.SetEdns0(tc.bufSize, false)
+			}
+			rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tc.tcp})
+			_, err := p.ServeDNS(context.TODO(), rec, m)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			resp := rec.Msg
+			if size := resp.Len(); size > tc.maxSize {
+				t.Errorf("response size %d exceeds %d", size, tc.maxSize)
+			}
+			if tc.bufSize > 0 && resp.IsEdns0() == nil {
+				t.Error("expected OPT RR in response")
+			}
+			if tc.wantFailure {
+				if resp.Rcode != dns.RcodeServerFailure || resp.Truncated ||
+					len(resp.Answer) != 0 {
+					t.Errorf("expected SERVFAIL without answers, got %v", resp)
+				}
+				return
+			}
+			if tc.wantAnswers == 0 {
+				if !resp.Truncated {
+					t.Error("expected TC bit to be set")
+				}
+				if len(resp.Answer) == 0 || len(resp.Answer) >= tc.numPeers {
+					t.Errorf("expected partial answer, got %d of %d RRs",
+						len(resp.Answer), tc.numPeers)
+				}
+				return
+			}
+			if resp.Truncated {
+				t.Error("unexpected TC bit")
+			}
+			if len(resp.Answer) != tc.wantAnswers {
+				t.Errorf("expected %d answers, got %d", tc.wantAnswers, len(resp.Answer))
+			}
+		})
+	}
+
+	// meshes exceeding the maximum message size are enumerated via zone
+	// transfers
+	p := newWGSD(2000)
+	p.Z["example.com."].soaNS = "ns1.example.com."
+	ptrs := 0
+	for _, rr := range collectTransfer(t, p, "example.com.", 0) {
+		if rr.Header().Rrtype == dns.TypePTR && rr.Header().Name == spPrefix+"example.com." {
+			ptrs++
+		}
+	}
+	if ptrs != 2000 {
+		t.Errorf("expected 2000 PTR RRs in zone transfer, got %d", ptrs)
+	}
+}
+
+func TestAllowedTXT(t *testing.T) {
+	txt := allowedTXT(nil)
+	if len(txt) != 1 || txt[0] != "allowed=" {
+		t.Fatalf("expected empty allowed key, got %v", txt)
+	}
+
+	var prefixes []string
+	for i := 0; i < 64; i++ {
+		prefixes = append(prefixes, fmt.Sprintf("fd00:%x::%x/128", i, i))
+	}
+	allowed, allowedString := constructAllowedIPs(t, prefixes)
+	txt = allowedTXT(allowed)
+	if len(txt) < 2 {
+		t.Fatalf("expected allowed IPs to be split, got %v", txt)
+	}
+	var values []string
+	for i, kv := range txt {
+		if len(kv) > maxTXTStringLen {
+			t.Errorf("character-string of %d bytes exceeds %d", len(kv),
+				maxTXTStringLen)
+		}
+		key := "allowed="
+		if i > 0 {
+			key = fmt.Sprintf("allowed%d=", i)
+		}
+		if !strings.HasPrefix(kv, key) {
+			t.Fatalf("expected key %s, got %s", key, kv)
+		}
+		values = append(values, strings.TrimPrefix(kv, key))
+	}
+	if got := strings.Join(values, ","); got != allowedString {
+		t.Errorf("expected allowed IPs %s, got %s", allowedString, got)
+	}
+}
+
+// benchmarkWGSD returns a WGSD serving a device with numPeers peers from a
+// refreshed snapshot, and the instance name of its last peer.
+func benchmarkWGSD(b *testing.B, numPeers int) (*WGSD, string) {
+	peers := make([]wgtypes.Peer, numPeers)
+	for i := range peers {
+		key := [32]byte{}
+		binary.BigEndian.PutUint32(key[:], uint32(i))
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		peers[i] = wgtypes.Peer{
+			Endpoint: &net.UDPAddr{
+				IP:   ip,
+				Port: 51820,
+			},
+			PublicKey: key,
+			AllowedIPs: []net.IPNet{{
+				IP:   ip,
+				Mask: net.CIDRMask(32, 32),
+			}},
+		}
+	}
+	client := &mockClient{
+		devices: map[string]*wgtypes.Device{
+			"wg0": {
+				Name:  "wg0",
+				Peers: peers,
+			},
+		},
+	}
+	zones := Zones{
+		Names: []string{"example.com."},
+		Z: map[string]*Zone{
+			"example.com.": {
+				name:            "example.com.",
+				devices:         []string{"wg0"},
+				ttl:             defaultTTLs,
+				refreshInterval: defaultRefreshInterval,
+				hosts:           true,
+			},
+		},
+	}
+	p := &WGSD{
+		Next:       test.ErrorHandler(),
+		Zones:      zones,
+		client:     client,
+		refreshers: newDeviceRefreshers(client, zones),
+	}
+	if err := p.refreshers["wg0"].refresh(context.Background()); err != nil {
+		b.Fatalf("error refreshing: %v", err)
+	}
+	return p, instanceName(zones.Z["example.com."], peers[numPeers-1])
+}
+
+func BenchmarkServeDNS(b *testing.B) {
+	queries := []struct {
+		name  string
+		qtype uint16
+		qname func(instance string) string
+	}{
+		{"SRV", dns.TypeSRV, func(instance string) string { return instance }},
+		{"TXT", dns.TypeTXT, func(instance string) string { return instance }},
+		{"A", dns.TypeA, func(instance string) string {
+			return strings.Replace(instance, spPrefix, "", 1)
+		}},
+	}
+	for _, q := range queries {
+		for _, numPeers := range []int{10, 1000, 100000} {
+			b.Run(fmt.Sprintf("%s/peers=%d", q.name, numPeers), func(b *testing.B) {
+				p, instance := benchmarkWGSD(b, numPeers)
+				m := new(dns.Msg)
+				m.SetQuestion(q.qname(instance), q.qtype)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				// the first query records the endpoints of the snapshot
+				p.ServeDNS(context.TODO(), rec, m) // nolint: errcheck
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					rcode, err := p.ServeDNS(context.TODO(), rec, m)
+					if err != nil || rcode != dns.RcodeSuccess {
+						b.Fatalf("unexpected rcode %d, err: %v", rcode, err)
+					}
+				}
+			})
+		}
+	}
+}